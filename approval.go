@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	//ApprovalPending is an approval waiting for a decision
+	ApprovalPending = "pending"
+	//ApprovalApproved is an approved job
+	ApprovalApproved = "approved"
+	//ApprovalRejected is a rejected job
+	ApprovalRejected = "rejected"
+	//ApprovalExpired is an approval nobody decided on in time
+	ApprovalExpired = "expired"
+)
+
+// Approval is the decision a job upgrading protected environments waits for
+type Approval struct {
+	Status       string     `json:"status"`
+	Environments []string   `json:"environments"`
+	Services     []string   `json:"services"`
+	Requested    time.Time  `json:"requested"`
+	Expires      time.Time  `json:"expires"`
+	DecidedBy    string     `json:"decided_by,omitempty"`
+	Decided      *time.Time `json:"decided,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+
+	decision     chan struct{}
+	slackChannel string
+	slackTS      string
+}
+
+// approvalDecision is the body of an approve or reject request
+type approvalDecision struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+// requireApproval parks the job until it is approved if any of the candidates is in an
+// environment requiring approval. It returns an error if the job was rejected or the approval expired.
+func (s *ServiceUpdater) requireApproval(job *Job, candidates []Candidate) error {
+	var envs, services []string
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if !utils.EnvironmentEnabled(c.Environment, s.Config.RequiresApproval) {
+			continue
+		}
+		if !seen[c.Environment] {
+			seen[c.Environment] = true
+			envs = append(envs, c.Environment)
+		}
+		services = append(services, fmt.Sprintf("%s (%s)", c.Service.Name, c.Environment))
+	}
+	if len(envs) == 0 {
+		return nil
+	}
+	sort.Strings(envs)
+
+	now := time.Now().UTC()
+	approval := &Approval{
+		Status:       ApprovalPending,
+		Environments: envs,
+		Services:     services,
+		Requested:    now,
+		Expires:      now.Add(s.Config.ApprovalTTL),
+		decision:     make(chan struct{}),
+	}
+	job.update(func() {
+		job.Approval = approval
+		job.Status = JobAwaitingApproval
+	})
+	s.jobLog(job).infof("Job %s awaits approval for %s", job.ID, strings.Join(envs, ", "))
+	s.requestApproval(job, approval)
+
+	select {
+	case <-approval.decision:
+	case <-time.After(s.Config.ApprovalTTL):
+		job.update(func() {
+			if approval.Status == ApprovalPending {
+				approval.Status = ApprovalExpired
+				close(approval.decision)
+			}
+		})
+	}
+	s.resolveApproval(job, approval)
+
+	s.audit.add(AuditApproval, approval.DecidedBy, map[string]interface{}{
+		"job": job.ID, "status": approval.Status, "environments": approval.Environments, "reason": approval.Reason,
+	})
+	var err error
+	job.update(func() {
+		switch approval.Status {
+		case ApprovalApproved:
+			job.Status = JobRunning
+		case ApprovalRejected:
+			err = fmt.Errorf("Rejected by %s", approval.DecidedBy)
+			if approval.Reason != "" {
+				err = fmt.Errorf("%s: %s", err, approval.Reason)
+			}
+		default:
+			err = fmt.Errorf("Approval expired")
+		}
+	})
+	if err != nil {
+		s.jobLog(job).warnf("Job %s was not approved: %s", job.ID, err)
+		s.slackMessage(s.jobLog(job), "danger", fmt.Sprintf("Job `%s` upgrading `%s` was not approved: %s", job.ID, job.name(), err.Error()))
+		return err
+	}
+	s.jobLog(job).infof("Job %s was approved by %s", job.ID, approval.DecidedBy)
+	return nil
+}
+
+// decide approves or rejects the job if it awaits approval
+func (j *Job) decide(status string, by string, reason string) error {
+	var err error
+	j.update(func() {
+		if j.Approval == nil || j.Approval.Status != ApprovalPending {
+			err = fmt.Errorf("Job %s is not awaiting approval", j.ID)
+			return
+		}
+		now := time.Now().UTC()
+		j.Approval.Status = status
+		j.Approval.DecidedBy = by
+		j.Approval.Decided = &now
+		j.Approval.Reason = reason
+		close(j.Approval.decision)
+	})
+	return err
+}
+
+// approvalEnvironments returns the environments the job awaits approval for
+func (j *Job) approvalEnvironments() []string {
+	var envs []string
+	j.update(func() {
+		if j.Approval != nil {
+			envs = j.Approval.Environments
+		}
+	})
+	return envs
+}
+
+// mayApprove checks that the token may decide on every environment of a job or promotion awaiting approval
+func (t *APIToken) mayApprove(envs []string) error {
+	return t.mayUse(ScopeApprove, envs...)
+}
+
+// unauthenticated names a decider that could not be verified as no tokens are configured. The
+// user given in the request is kept, but marked as such.
+func unauthenticated(user string, r *http.Request) string {
+	if user == "" {
+		user = caller(r)
+	}
+	return fmt.Sprintf("%s (unauthenticated)", user)
+}
+
+// approvalHandler handles POST /jobs/{id}/approve and /jobs/{id}/reject
+func (s *ServiceUpdater) approvalHandler(w http.ResponseWriter, r *http.Request, job *Job, action string) {
+	status := ApprovalApproved
+	if action == "reject" {
+		status = ApprovalRejected
+	} else if action != "approve" {
+		utils.SendError(w, "Not found", 404)
+		return
+	}
+	var decision approvalDecision
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			utils.SendError(w, err.Error(), 400)
+			return
+		}
+	}
+	var by string
+	if token := requestToken(r); token != nil {
+		by = token.Name
+		if err := token.mayApprove(job.approvalEnvironments()); err != nil {
+			utils.SendError(w, err.Error(), 403)
+			return
+		}
+	} else {
+		by = unauthenticated(decision.User, r)
+	}
+	if err := job.decide(status, by, decision.Reason); err != nil {
+		utils.SendError(w, err.Error(), 409)
+		return
+	}
+	sendJSON(w, job, 200)
+}
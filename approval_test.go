@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func waitForApproval(t *testing.T, job *Job) {
+	for i := 0; i < 100; i++ {
+		job.mu.Lock()
+		status := job.Status
+		job.mu.Unlock()
+		if status == JobAwaitingApproval {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s is not awaiting approval", job.ID)
+}
+
+func newApprovalUpdater() (*ServiceUpdater, *mockService) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	updater.Config.RequiresApproval = []string{"^dev$"}
+	updater.Config.ApprovalTTL = time.Minute
+	return updater, service
+}
+
+func Test_requireApproval(t *testing.T) {
+	updater, service := newApprovalUpdater()
+	updater.Config.APITokens = []APIToken{{Name: "alice", Token: "t0ken", Scopes: []string{ScopeApprove}}}
+	job := updater.jobStore.create("myorg/api:2.0")
+	go updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	waitForApproval(t, job)
+	job.mu.Lock()
+	services := job.Approval.Services
+	job.mu.Unlock()
+	if services[0] != "api (dev)" {
+		t.Fatalf("expected job to be parked with its plan, got %v", services)
+	}
+
+	handler := updater.authorize(ScopeRead, ScopeApprove, updater.jobs)
+	req := httptest.NewRequest("POST", "/jobs/"+job.ID+"/approve", nil)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected approval to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	waitForJob(t, job)
+	if job.Status != JobSucceeded || job.Approval.Status != ApprovalApproved || job.Approval.DecidedBy != "alice" || len(service.finished) != 1 {
+		t.Errorf("expected approved job to succeed, got %s %+v", job.Status, job.Approval)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/jobs/"+job.ID+"/approve", nil))
+	if w.Code != 401 {
+		t.Errorf("expected request without token to be unauthorized, got %d", w.Code)
+	}
+}
+
+func Test_rejectApproval(t *testing.T) {
+	updater, service := newApprovalUpdater()
+	job := updater.jobStore.create("myorg/api:2.0")
+	go updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	waitForApproval(t, job)
+
+	w := httptest.NewRecorder()
+	updater.jobs(w, httptest.NewRequest("POST", "/jobs/"+job.ID+"/reject", strings.NewReader(`{"user": "bob", "reason": "not today"}`)))
+	if w.Code != 200 {
+		t.Fatalf("expected rejection to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	waitForJob(t, job)
+	if job.Status != JobFailed || job.Error != "Rejected by bob (unauthenticated): not today" || len(service.upgrades) != 0 {
+		t.Errorf("expected rejected job to fail without upgrading, got %s %s", job.Status, job.Error)
+	}
+	if err := job.decide(ApprovalApproved, "carol", ""); err == nil {
+		t.Error("expected decided job not to be approved again")
+	}
+}
+
+func Test_approvalRechecked(t *testing.T) {
+	for _, tc := range []struct {
+		image  string
+		status string
+	}{
+		{"docker:myorg/api:1.5", ServiceSucceeded},
+		{"docker:myorg/api:2.0", ServiceSkipped},
+	} {
+		updater, service := newApprovalUpdater()
+		job := updater.jobStore.create("myorg/api:2.0")
+		go updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+		waitForApproval(t, job)
+
+		// The service was changed in Rancher while the job waited for the approval
+		service.mu.Lock()
+		service.services[0].LaunchConfig = &client.LaunchConfig{
+			ImageUuid: tc.image,
+			Labels:    map[string]interface{}{"autoupdate.enable": "true", "tier": "web"},
+		}
+		service.mu.Unlock()
+		if err := job.decide(ApprovalApproved, "alice", ""); err != nil {
+			t.Fatal(err)
+		}
+		waitForJob(t, job)
+
+		if len(job.Services) != 1 || job.Services[0].Status != tc.status {
+			t.Fatalf("expected the service of %s to be %s, got %+v", tc.image, tc.status, job.Services)
+		}
+		if tc.status == ServiceSkipped {
+			if len(service.upgrades) != 0 || job.Services[0].Reason == "" {
+				t.Errorf("expected the upgraded service not to be upgraded again, got %+v", job.Services[0])
+			}
+			continue
+		}
+		if launchConfig := service.upgrades[0].InServiceStrategy.LaunchConfig; launchConfig.Labels["tier"] != "web" || job.Services[0].FromImage != tc.image {
+			t.Errorf("expected the upgrade to start from the current launch config, got %+v %+v", launchConfig, job.Services[0])
+		}
+	}
+}
+
+func Test_approvalExpired(t *testing.T) {
+	updater, service := newApprovalUpdater()
+	updater.Config.ApprovalTTL = 20 * time.Millisecond
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if job.Status != JobFailed || job.Approval.Status != ApprovalExpired || len(service.upgrades) != 0 {
+		t.Errorf("expected expired job to fail, got %s %+v", job.Status, job.Approval)
+	}
+}
+
+func Test_authorize(t *testing.T) {
+	tokens, err := parseTokens([]string{"ci:s3cret:upgrade", "alice:t0ken:read+approve:^production$"})
+	if err != nil || len(tokens) != 2 || tokens[1].Environments != "^production$" {
+		t.Fatalf("unexpected tokens %+v %v", tokens, err)
+	}
+	if _, err := parseTokens([]string{"ci:s3cret:deploy"}); err == nil {
+		t.Error("expected unknown scope to fail")
+	}
+	updater, _ := newTestUpdater()
+	updater.Config.APITokens = tokens
+	handler := updater.authorize(ScopeRead, ScopeApprove, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(requestToken(r).Name))
+	})
+	for _, test := range []struct {
+		method, token string
+		code          int
+	}{
+		{"GET", "s3cret", 403},
+		{"GET", "t0ken", 200},
+		{"POST", "t0ken", 200},
+		{"POST", "wrong", 401},
+	} {
+		req := httptest.NewRequest(test.method, "/jobs", nil)
+		req.Header.Set("X-Autoupdate-Token", test.token)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s with %s: expected %d, got %d", test.method, test.token, test.code, w.Code)
+		}
+	}
+	if !tokens[1].allowsEnvironment("production") || tokens[1].allowsEnvironment("dev") {
+		t.Error("expected token to be restricted to production")
+	}
+}
+
+func Test_upgradeScoped(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	updater.Config.APITokens = []APIToken{{Name: "ci", Token: "t0ken", Scopes: []string{ScopeUpgrade}, Environments: "^staging$"}}
+	handler := updater.authorize(ScopeRead, ScopeUpgrade, updater.upgrade)
+	req := httptest.NewRequest("POST", "/upgrade", strings.NewReader(`{"docker_image": "myorg/api:2.0", "confirm": true, "timeout": 1}`))
+	req.Header.Set("Authorization", "Bearer t0ken")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected the upgrade to be accepted, got %d %s", w.Code, w.Body.String())
+	}
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	job := updater.jobStore.get(body["job_id"])
+	waitForJob(t, job)
+	if job.Status != JobFailed || job.Error != "Token ci may not upgrade in dev" || len(service.upgrades) != 0 {
+		t.Errorf("expected the upgrade outside the token scope to fail, got %s %s", job.Status, job.Error)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	//AuditConfigLoaded is recorded when the updater starts with its configuration
+	AuditConfigLoaded = "config_loaded"
+	//AuditTrigger is a received upgrade or rollback request
+	AuditTrigger = "trigger_received"
+	//AuditAuthFailure is a request rejected for missing or insufficient credentials
+	AuditAuthFailure = "auth_failure"
+	//AuditApproval is an approval decision on a job or a promotion
+	AuditApproval = "approval"
+	//AuditUpgrade is the outcome of the upgrade of a service
+	AuditUpgrade = "upgrade"
+	//AuditRollback is a rollback of a service or a stack
+	AuditRollback = "rollback"
+	//AuditFreeze is a change freeze being added or removed
+	AuditFreeze = "freeze"
+	//AuditHold is a service being held or released
+	AuditHold = "hold"
+	//AuditPause is upgrades being paused or resumed
+	AuditPause = "pause"
+
+	auditFile = "audit.jsonl"
+)
+
+// AuditRecord is one event of the audit log. Hash is the SHA-256 of the record with an empty
+// hash, which includes the hash of the previous record, so that editing, removing or reordering
+// records breaks the chain.
+type AuditRecord struct {
+	Seq     int64           `json:"seq"`
+	Time    time.Time       `json:"time"`
+	Event   string          `json:"event"`
+	Actor   string          `json:"actor"`
+	Details json.RawMessage `json:"details,omitempty"`
+	Prev    string          `json:"prev"`
+	Hash    string          `json:"hash"`
+}
+
+// AuditLog appends hash chained records to a file. A nil AuditLog records nothing.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	last string
+	log  *Logger
+}
+
+// hash computes the hash of the record
+func (r AuditRecord) hash() string {
+	r.Hash = ""
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// openAuditLog opens the audit log for appending, continuing the chain of its last record.
+// It fails if the chain of the existing records is broken, so that a truncated or tampered log
+// is noticed when the updater starts rather than extended.
+func openAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if count, err := verifyAudit(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Audit log %s is broken after %d valid records: %s", path, count, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	a := &AuditLog{file: file}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var record AuditRecord
+		json.Unmarshal(scanner.Bytes(), &record)
+		a.seq, a.last = record.Seq, record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// add appends an event with its details to the log
+func (a *AuditLog) add(event string, actor string, details map[string]interface{}) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	record := AuditRecord{Seq: a.seq + 1, Time: time.Now().UTC(), Event: event, Actor: actor, Prev: a.last}
+	if len(details) > 0 {
+		record.Details, _ = json.Marshal(details)
+	}
+	record.Hash = record.hash()
+	line, _ := json.Marshal(record)
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		a.log.errorf("Unable to write audit log: %s", err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		a.log.errorf("Unable to sync audit log: %s", err)
+	}
+	a.seq, a.last = record.Seq, record.Hash
+}
+
+// verifyAudit checks the chain of an audit log and returns the number of valid records.
+// The error describes the first broken record.
+func verifyAudit(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var prev AuditRecord
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return count, fmt.Errorf("line %d: invalid record: %s", line, err)
+		}
+		switch {
+		case record.Hash != record.hash():
+			return count, fmt.Errorf("line %d: record %d was modified, its hash does not match", line, record.Seq)
+		case record.Prev != prev.Hash:
+			return count, fmt.Errorf("line %d: record %d does not follow record %d, records were removed or reordered", line, record.Seq, prev.Seq)
+		case record.Seq != prev.Seq+1:
+			return count, fmt.Errorf("line %d: record %d does not follow record %d", line, record.Seq, prev.Seq)
+		}
+		prev = record
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// auditLogPath returns AUTOUPDATE_AUDIT_LOG, or audit.jsonl in the data directory if one is configured
+func auditLogPath() string {
+	if path := os.Getenv("AUTOUPDATE_AUDIT_LOG"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("AUTOUPDATE_DATA_DIR"); dir != "" {
+		return filepath.Join(dir, auditFile)
+	}
+	return ""
+}
+
+// runVerify implements the verify command, checking the audit log at the path
+func runVerify(path string) int {
+	if path == "" {
+		fmt.Println("Usage: rancher-service-updater verify <audit log>, or set AUTOUPDATE_AUDIT_LOG")
+		return 2
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Unable to open audit log: %s\n", err)
+		return 2
+	}
+	defer file.Close()
+	count, err := verifyAudit(file)
+	if err != nil {
+		fmt.Printf("Audit log %s is broken after %d valid records: %s\n", path, count, err)
+		return 1
+	}
+	fmt.Printf("Audit log %s is intact, %d records\n", path, count)
+	return 0
+}
+
+// auditConfig records the configuration the updater was started with, without secrets
+func (s *ServiceUpdater) auditConfig() {
+	tokens := make([]string, 0, len(s.Config.APITokens))
+	for _, token := range s.Config.APITokens {
+		tokens = append(tokens, fmt.Sprintf("%s:%v:%s", token.Name, token.Scopes, token.Environments))
+	}
+	promotions := make([]string, 0, len(s.Config.Promotions))
+	for _, rule := range s.Config.Promotions {
+		promotions = append(promotions, fmt.Sprintf("%s=>%s", rule.From, rule.To))
+	}
+	windows := make([]string, 0, len(s.Config.Windows))
+	for _, window := range s.Config.Windows {
+		windows = append(windows, fmt.Sprintf("%s|%s", window.Environment, window.Spec))
+	}
+	s.audit.add(AuditConfigLoaded, "updater", map[string]interface{}{
+		"enable_label":      s.Config.EnableLabel,
+		"environment_names": s.Config.EnvironmentNames,
+		"failure_policy":    s.Config.FailurePolicy,
+		"requires_approval": s.Config.RequiresApproval,
+		"promotions":        promotions,
+		"windows":           windows,
+		"api_tokens":        tokens,
+		"slack_users":       len(s.Config.SlackUsers),
+	})
+}
+
+// auditJob records a received trigger by the job it started
+func (s *ServiceUpdater) auditJob(job *Job) {
+	job.mu.Lock()
+	details := map[string]interface{}{"job": job.ID, "trigger": job.Trigger, "image": job.Image, "environments": job.Environments}
+	if job.Release != "" {
+		details["release"], details["images"] = job.Release, job.Images
+	}
+	actor := job.Caller
+	job.mu.Unlock()
+	s.audit.add(AuditTrigger, actor, details)
+}
+
+// auditRollback records a rollback and its outcome
+func (s *ServiceUpdater) auditRollback(actor string, details map[string]interface{}, err error) {
+	details["outcome"] = "succeeded"
+	if err != nil {
+		details["outcome"] = "failed"
+		details["error"] = err.Error()
+	}
+	s.audit.add(AuditRollback, actor, details)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_auditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, auditFile)
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater, _ := newTestUpdater(testService(map[string]interface{}{}))
+	updater.audit = audit
+	updater.Config.APITokens = []APIToken{{Name: "ci", Token: "s3cret", Scopes: []string{ScopeRead}}}
+	updater.auditConfig()
+	handler := updater.authorize(ScopeRead, ScopeUpgrade, updater.upgrade)
+	r := httptest.NewRequest("POST", "/upgrade", strings.NewReader(`{"docker_image": "myorg/api:2.0"}`))
+	handler(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("POST", "/upgrade", strings.NewReader(`{"docker_image": "myorg/api:2.0"}`))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	handler(httptest.NewRecorder(), r)
+
+	reopened, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.add(AuditFreeze, "alice", map[string]interface{}{"action": "added"})
+
+	content, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 records, got %s", content)
+	}
+	for i, event := range []string{AuditConfigLoaded, AuditAuthFailure, AuditAuthFailure, AuditFreeze} {
+		if !strings.Contains(lines[i], `"event":"`+event+`"`) {
+			t.Errorf("expected record %d to be %s, got %s", i+1, event, lines[i])
+		}
+	}
+	if strings.Contains(string(content), "s3cret") {
+		t.Error("expected the audit log not to contain secrets")
+	}
+	if count, err := verifyAudit(bytes.NewReader(content)); count != 4 || err != nil {
+		t.Errorf("expected 4 valid records, got %d %v", count, err)
+	}
+	if code := runVerify(path); code != 0 {
+		t.Errorf("expected verify to succeed, got %d", code)
+	}
+
+	edited := strings.Replace(string(content), `"actor":"ci"`, `"actor":"bob"`, 1)
+	if count, err := verifyAudit(strings.NewReader(edited)); count != 2 || err == nil || !strings.Contains(err.Error(), "line 3: record 3 was modified") {
+		t.Errorf("expected the edited record to be reported, got %d %v", count, err)
+	}
+	removed := strings.Join(append(lines[:1:1], lines[2:]...), "\n")
+	if count, err := verifyAudit(strings.NewReader(removed)); count != 1 || err == nil || !strings.Contains(err.Error(), "line 2: record 3 does not follow record 1") {
+		t.Errorf("expected the removed record to be reported, got %d %v", count, err)
+	}
+	ioutil.WriteFile(path, []byte(edited), 0600)
+	if code := runVerify(path); code != 1 {
+		t.Errorf("expected verify to fail, got %d", code)
+	}
+	if _, err := openAuditLog(path); err == nil || !strings.Contains(err.Error(), "broken after 2 valid records") {
+		t.Errorf("expected the broken log not to be opened, got %v", err)
+	}
+	ioutil.WriteFile(path, []byte(strings.Join(lines[:2], "\n")+"\n{\"seq\":3"), 0600)
+	if _, err := openAuditLog(path); err == nil || !strings.Contains(err.Error(), "line 3: invalid record") {
+		t.Errorf("expected the truncated log not to be opened, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	//ScopeRead allows reading jobs, promotions and other state
+	ScopeRead = "read"
+	//ScopeUpgrade allows triggering upgrades
+	ScopeUpgrade = "upgrade"
+	//ScopeApprove allows approving and rejecting jobs and promotions
+	ScopeApprove = "approve"
+	//ScopeAdmin allows everything, including rollbacks and freezes
+	ScopeAdmin = "admin"
+)
+
+type tokenKey struct{}
+
+// APIToken is a named token allowed to use the API with some scopes
+type APIToken struct {
+	Name         string
+	Token        string
+	Scopes       []string
+	Environments string
+}
+
+// parseTokens parses tokens in the form `name:token:scope+scope[:environment pattern]`
+func parseTokens(values []string) ([]APIToken, error) {
+	var tokens []APIToken
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		parts := strings.SplitN(value, ":", 4)
+		if len(parts) < 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid API token %s, expected name:token:scopes", parts[0])
+		}
+		token := APIToken{Name: parts[0], Token: parts[1], Scopes: strings.Split(parts[2], "+")}
+		for _, scope := range token.Scopes {
+			switch scope {
+			case ScopeRead, ScopeUpgrade, ScopeApprove, ScopeAdmin:
+			default:
+				return nil, fmt.Errorf("Unknown scope %s of API token %s", scope, token.Name)
+			}
+		}
+		if len(parts) == 4 {
+			if _, err := regexp.Compile(parts[3]); err != nil {
+				return nil, fmt.Errorf("Invalid environment pattern of API token %s: %s", token.Name, err)
+			}
+			token.Environments = parts[3]
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// allows reports whether the token has the scope, admin tokens having every scope
+func (t *APIToken) allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsEnvironment reports whether the token may act on the environment
+func (t *APIToken) allowsEnvironment(env string) bool {
+	return t.Environments == "" || utils.EnvironmentEnabled(env, []string{t.Environments})
+}
+
+// mayUse checks that the token may use the scope in every environment. Without a token, as when
+// tokens are not configured, every environment is allowed.
+func (t *APIToken) mayUse(scope string, envs ...string) error {
+	if t == nil {
+		return nil
+	}
+	for _, env := range envs {
+		if !t.allowsEnvironment(env) {
+			return fmt.Errorf("Token %s may not %s in %s", t.Name, scope, env)
+		}
+	}
+	return nil
+}
+
+// authorize requires a token with the read scope for GET requests and the write scope for the others.
+// Without configured tokens every request is allowed.
+func (s *ServiceUpdater) authorize(read string, write string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.Config.APITokens) == 0 {
+			next(w, r)
+			return
+		}
+		secret := r.Header.Get("X-Autoupdate-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			secret = strings.TrimPrefix(auth, "Bearer ")
+		}
+		var token *APIToken
+		for i := range s.Config.APITokens {
+			if subtle.ConstantTimeCompare([]byte(secret), []byte(s.Config.APITokens[i].Token)) == 1 {
+				token = &s.Config.APITokens[i]
+			}
+		}
+		if token == nil {
+			s.audit.add(AuditAuthFailure, caller(r), map[string]interface{}{"method": r.Method, "path": r.URL.Path, "reason": "invalid token"})
+			utils.SendError(w, "Unauthorized", 401)
+			return
+		}
+		scope := write
+		if r.Method == "GET" {
+			scope = read
+		}
+		if !token.allows(scope) {
+			s.audit.add(AuditAuthFailure, token.Name, map[string]interface{}{"method": r.Method, "path": r.URL.Path, "reason": "missing scope " + scope})
+			utils.SendError(w, fmt.Sprintf("Token %s does not have the %s scope", token.Name, scope), 403)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	}
+}
+
+// caller identifies who sent the request, by the name of its token or else its remote address
+func caller(r *http.Request) string {
+	if token := requestToken(r); token != nil {
+		return token.Name
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// requestToken returns the token the request was authorized with, or nil if tokens are not configured
+func requestToken(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(tokenKey{}).(*APIToken)
+	return token
+}
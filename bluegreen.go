@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+	"github.com/rancher/go-rancher/client"
+)
+
+const (
+	blueGreenNameLabel = "autoupdate.bluegreen.name"
+	blueGreenFile      = "bluegreen.json"
+
+	//StageGreen is a blue/green upgrade waiting for the new service to become healthy
+	StageGreen = "green"
+	//StageSwitching is a blue/green upgrade moving traffic to the new service
+	StageSwitching = "switching"
+)
+
+var nonNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// BlueGreen is a deactivated blue service that is kept for fast rollback
+type BlueGreen struct {
+	BlueID      string    `json:"blue_id"`
+	Blue        string    `json:"blue"`
+	GreenID     string    `json:"green_id"`
+	Green       string    `json:"green"`
+	Environment string    `json:"environment"`
+	Expires     time.Time `json:"expires,omitempty"`
+}
+
+// BlueGreenStore keeps track of the blue services awaiting cleanup and saves them to
+// bluegreen.json in the data directory, if one is configured
+type BlueGreenStore struct {
+	mu      sync.Mutex
+	entries map[string]*BlueGreen
+	path    string
+}
+
+// openBlueGreen loads the blue services saved in the data directory. Without a data directory
+// they are kept in memory only.
+func openBlueGreen(dir string) (*BlueGreenStore, error) {
+	bs := &BlueGreenStore{entries: make(map[string]*BlueGreen)}
+	if dir == "" {
+		return bs, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	bs.path = filepath.Join(dir, blueGreenFile)
+	content, err := ioutil.ReadFile(bs.path)
+	if os.IsNotExist(err) {
+		return bs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*BlueGreen
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", bs.path, err)
+	}
+	for _, e := range entries {
+		bs.entries[e.BlueID] = e
+	}
+	return bs, nil
+}
+
+// sorted returns the entries by blue service name. It must be called with the lock held.
+func (bs *BlueGreenStore) sorted() []*BlueGreen {
+	entries := make([]*BlueGreen, 0, len(bs.entries))
+	for _, e := range bs.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Blue < entries[k].Blue })
+	return entries
+}
+
+// save writes the entries to the blue/green file, replacing it atomically. It must be called with the lock held.
+func (bs *BlueGreenStore) save() error {
+	if bs.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(bs.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := bs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bs.path)
+}
+
+func (bs *BlueGreenStore) put(entry *BlueGreen) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.entries[entry.BlueID] = entry
+	return bs.save()
+}
+
+func (bs *BlueGreenStore) get(blueID string) *BlueGreen {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.entries[blueID]
+}
+
+func (bs *BlueGreenStore) remove(blueID string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	delete(bs.entries, blueID)
+	return bs.save()
+}
+
+func (bs *BlueGreenStore) list() []*BlueGreen {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.sorted()
+}
+
+// greenName returns the name of the sibling service for the version
+func greenName(service client.Service, version string) string {
+	base := service.Name
+	if name, ok := label(service.LaunchConfig.Labels, blueGreenNameLabel); ok && name != "" {
+		base = name
+	}
+	slug := strings.Trim(nonNameChars.ReplaceAllString(strings.ToLower(version), "-"), "-")
+	return fmt.Sprintf("%s-%s", base, slug)
+}
+
+// waitForState polls the service until it reaches the state, or the timeout expires
+func (s *ServiceUpdater) waitForState(id string, state string, timeout time.Duration) (*client.Service, error) {
+	srv, err := utils.Retry(s.poll("poll "+state, func(t *ServiceUpdater) (interface{}, error) {
+		svc, e := t.serviceByID(id)
+		if e != nil {
+			return nil, e
+		}
+		if svc.State != state {
+			return nil, fmt.Errorf("Service %s not %s: %s", svc.Name, state, svc.State)
+		}
+		return svc, nil
+	}), timeout, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return srv.(*client.Service), nil
+}
+
+func (s *ServiceUpdater) waitForHealthy(id string, timeout time.Duration) (*client.Service, error) {
+	srv, err := utils.Retry(s.poll("poll healthy", func(t *ServiceUpdater) (interface{}, error) {
+		svc, e := t.serviceByID(id)
+		if e != nil {
+			return nil, e
+		}
+		if svc.State != "active" || (svc.HealthState != "" && svc.HealthState != "healthy") {
+			return nil, fmt.Errorf("Service %s not healthy: %s/%s", svc.Name, svc.State, svc.HealthState)
+		}
+		return svc, nil
+	}), timeout, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return srv.(*client.Service), nil
+}
+
+// upgradeBlueGreen creates a sibling service with the new image and, once it is healthy,
+// moves traffic to it using the Rancher to-service upgrade. The old service is kept
+// deactivated for fast rollback until it is cleaned up. It reports whether a failed
+// upgrade was rolled back.
+func (s *ServiceUpdater) upgradeBlueGreen(job *Job, target *JobService, command UpdateCommand, c Candidate, event HookEvent) (bool, error) {
+	blue := c.Service
+	log := s.jobLog(job).forEvent(event)
+	batchSize, interval, err := batchSettings(command, blue)
+	if err != nil {
+		return false, err
+	}
+	timeout := time.Duration(command.Timeout) * time.Second
+
+	launchConfig := c.launchConfig(command.Image)
+	launchConfig.Labels = make(map[string]interface{})
+	for k, v := range blue.LaunchConfig.Labels {
+		launchConfig.Labels[k] = v
+	}
+	name := greenName(blue, event.ToVersion)
+	if _, ok := launchConfig.Labels[blueGreenNameLabel]; !ok {
+		launchConfig.Labels[blueGreenNameLabel] = blue.Name
+	}
+
+	job.update(func() { target.Stage = StageGreen })
+	green, err := s.service.Create(&client.Service{
+		Name:                   name,
+		EnvironmentId:          blue.EnvironmentId,
+		Scale:                  blue.Scale,
+		StartOnCreate:          true,
+		LaunchConfig:           launchConfig,
+		SecondaryLaunchConfigs: upgradedSidekicks(blue.SecondaryLaunchConfigs, c.Sidekicks, command.Image),
+		Metadata:               blue.Metadata,
+	})
+	if err != nil {
+		return false, err
+	}
+	discard := func(cause error) error {
+		if err := s.removeService(green.Id); err != nil {
+			return fmt.Errorf("%s, unable to remove %s: %s", cause, green.Name, err)
+		}
+		return cause
+	}
+	// abort applies the failure policy to the blue service once traffic started moving
+	// and discards the green service
+	abort := func(cause error) (bool, error) {
+		if policyErr := s.handleFailure(blue); policyErr != nil {
+			log.errorf("Failure policy for service %s failed: %s", blue.Name, policyErr)
+			return false, discard(cause)
+		}
+		return s.failurePolicy(blue) == FailurePolicyRollback, discard(cause)
+	}
+
+	healthy, err := s.waitForHealthy(green.Id, timeout)
+	if err != nil {
+		return false, discard(err)
+	}
+	if err := s.verifyService(*healthy, command.Image); err != nil {
+		return false, discard(err)
+	}
+	if err := s.runHooks(HookPreFinish, event); err != nil {
+		return false, discard(err)
+	}
+
+	job.update(func() { target.Stage = StageSwitching })
+	current, err := s.serviceByID(blue.Id)
+	if err != nil {
+		return false, discard(err)
+	}
+	_, err = s.service.ActionUpgrade(current, &client.ServiceUpgrade{
+		ToServiceStrategy: &client.ToServiceUpgradeStrategy{
+			ToServiceId:    green.Id,
+			UpdateLinks:    true,
+			FinalScale:     blue.Scale,
+			BatchSize:      batchSize,
+			IntervalMillis: interval,
+		},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	upgraded, err := s.waitForState(blue.Id, "upgraded", timeout)
+	if err != nil {
+		return abort(err)
+	}
+	entry := &BlueGreen{
+		BlueID:      blue.Id,
+		Blue:        blue.Name,
+		GreenID:     green.Id,
+		Green:       green.Name,
+		Environment: event.Environment,
+	}
+	if s.Config.BlueGreenTTL > 0 {
+		entry.Expires = time.Now().UTC().Add(s.Config.BlueGreenTTL)
+	}
+	if err := s.blueGreen.put(entry); err != nil {
+		log.errorf("Unable to save %s for rollback: %s", blue.Name, err)
+	}
+	if !command.Confirm {
+		log.infof("Moved %s to %s, keeping %s for rollback", blue.Name, green.Name, blue.Name)
+		return false, nil
+	}
+	if _, err := s.service.ActionFinishupgrade(upgraded); err != nil {
+		return s.abortBlueGreen(log, blue, entry, err)
+	}
+	finished, err := s.waitForState(blue.Id, "active", timeout)
+	if err != nil {
+		return s.abortBlueGreen(log, blue, entry, err)
+	}
+	if _, err := s.service.ActionDeactivate(finished); err != nil {
+		return s.abortBlueGreen(log, blue, entry, err)
+	}
+	log.infof("Moved %s to %s, keeping %s for rollback", blue.Name, green.Name, blue.Name)
+	return false, nil
+}
+
+// abortBlueGreen applies the failure policy to a blue/green upgrade whose traffic has
+// already moved to the green service. Rolling back moves it to the blue service again
+// and discards the green service.
+func (s *ServiceUpdater) abortBlueGreen(log *Logger, blue client.Service, entry *BlueGreen, cause error) (bool, error) {
+	var err error
+	switch policy := s.failurePolicy(blue); policy {
+	case FailurePolicyRollback:
+		s.log.warnf("Rolling back service %s", entry.Blue)
+		err = s.rollbackBlueGreen(entry)
+		s.auditRollback("updater", map[string]interface{}{"service": entry.Blue, "service_id": entry.BlueID, "reason": "failure policy"}, err)
+	case FailurePolicyNone, "":
+		return false, cause
+	default:
+		err = fmt.Errorf("Unknown failure policy %s for service %s", policy, entry.Blue)
+	}
+	if err != nil {
+		log.errorf("Failure policy for service %s failed: %s", entry.Blue, err)
+		return false, cause
+	}
+	return true, cause
+}
+
+// removeService removes the service. A service that no longer exists is already removed.
+func (s *ServiceUpdater) removeService(id string) error {
+	svc, err := s.service.ById(id)
+	if err != nil || svc == nil {
+		return err
+	}
+	_, err = s.service.ActionRemove(svc)
+	return err
+}
+
+// rollbackBlueGreen reactivates the blue service, moves traffic back to it and removes the green service.
+// A blue service whose upgrade was not confirmed is rolled back instead.
+func (s *ServiceUpdater) rollbackBlueGreen(entry *BlueGreen) error {
+	blue, err := s.serviceByID(entry.BlueID)
+	if err != nil {
+		return err
+	}
+	if blue.State == "upgraded" {
+		return s.rollbackUnfinished(entry, blue)
+	}
+	if _, err := s.service.ActionActivate(blue); err != nil {
+		return err
+	}
+	if _, err := s.waitForHealthy(entry.BlueID, 5*time.Minute); err != nil {
+		return err
+	}
+	green, err := s.serviceByID(entry.GreenID)
+	if err != nil {
+		return err
+	}
+	_, err = s.service.ActionUpgrade(green, &client.ServiceUpgrade{
+		ToServiceStrategy: &client.ToServiceUpgradeStrategy{
+			ToServiceId: entry.BlueID,
+			UpdateLinks: true,
+			FinalScale:  green.Scale,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	upgraded, err := s.waitForState(entry.GreenID, "upgraded", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	if _, err := s.service.ActionFinishupgrade(upgraded); err != nil {
+		return err
+	}
+	if _, err := s.waitForState(entry.GreenID, "active", 5*time.Minute); err != nil {
+		return err
+	}
+	return s.dropGreen(entry)
+}
+
+// rollbackUnfinished rolls back the to-service upgrade of the blue service and removes the green service
+func (s *ServiceUpdater) rollbackUnfinished(entry *BlueGreen, blue *client.Service) error {
+	if _, err := s.service.ActionRollback(blue); err != nil {
+		return err
+	}
+	if _, err := s.waitForState(entry.BlueID, "active", 5*time.Minute); err != nil {
+		return err
+	}
+	return s.dropGreen(entry)
+}
+
+func (s *ServiceUpdater) dropGreen(entry *BlueGreen) error {
+	if err := s.removeService(entry.GreenID); err != nil {
+		return err
+	}
+	if err := s.blueGreen.remove(entry.BlueID); err != nil {
+		return err
+	}
+	s.log.infof("Rolled back %s to %s", entry.Green, entry.Blue)
+	return nil
+}
+
+// cleanupBlueGreen removes the deactivated blue service. A blue service that was already
+// removed is dropped as well.
+func (s *ServiceUpdater) cleanupBlueGreen(entry *BlueGreen) error {
+	if err := s.removeService(entry.BlueID); err != nil {
+		return err
+	}
+	if err := s.blueGreen.remove(entry.BlueID); err != nil {
+		return err
+	}
+	s.log.infof("Removed %s after upgrade to %s", entry.Blue, entry.Green)
+	return nil
+}
+
+// sweepBlueGreen removes blue services whose TTL has expired
+func (s *ServiceUpdater) sweepBlueGreen() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		for _, entry := range s.blueGreen.list() {
+			if !entry.Expires.IsZero() && now.After(entry.Expires) {
+				if err := s.cleanupBlueGreen(entry); err != nil {
+					s.log.errorf("Unable to remove %s: %s", entry.Blue, err)
+				}
+			}
+		}
+	}
+}
+
+func (s *ServiceUpdater) blueGreenHandler(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/bluegreen"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != "GET" {
+			utils.SendError(w, "Method not allowed", 405)
+			return
+		}
+		sendJSON(w, s.blueGreen.list(), 200)
+		return
+	}
+	if len(parts) != 2 || r.Method != "POST" {
+		utils.SendError(w, "Not found", 404)
+		return
+	}
+	entry := s.blueGreen.get(parts[0])
+	if entry == nil {
+		utils.SendError(w, "Blue/green upgrade not found", 404)
+		return
+	}
+	var err error
+	switch parts[1] {
+	case "rollback":
+		err = s.rollbackBlueGreen(entry)
+		s.auditRollback(caller(r), map[string]interface{}{"service": entry.Green, "to": entry.Blue, "environment": entry.Environment}, err)
+	case "cleanup":
+		err = s.cleanupBlueGreen(entry)
+	default:
+		utils.SendError(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		utils.SendError(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_upgradeBlueGreen(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{strategyLabel: StrategyBlueGreen}))
+	updater.Config.BlueGreenTTL = time.Hour
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if job.Status != JobSucceeded {
+		t.Fatalf("unexpected job %+v", job.Services[0])
+	}
+	green := service.services[1]
+	if green.Name != "api-2-0" || green.LaunchConfig.ImageUuid != "docker:myorg/api:2.0" || green.LaunchConfig.Labels[blueGreenNameLabel] != "api" {
+		t.Errorf("unexpected green service %+v", green)
+	}
+	if service.services[0].LaunchConfig.ImageUuid != "docker:myorg/api:1.0" {
+		t.Errorf("expected blue launch config to be untouched")
+	}
+	to := service.upgrades[0].ToServiceStrategy
+	if to.ToServiceId != green.Id || !to.UpdateLinks || to.FinalScale != 2 {
+		t.Errorf("unexpected to-service strategy %+v", to)
+	}
+	if len(service.deactivated) != 1 || service.deactivated[0] != "1s1" {
+		t.Errorf("expected blue service to be deactivated")
+	}
+	entry := updater.blueGreen.get("1s1")
+	if entry == nil || entry.GreenID != green.Id || entry.Expires.IsZero() {
+		t.Fatalf("expected blue service to be kept for rollback, got %+v", entry)
+	}
+
+	job = updater.jobStore.create("myorg/api:3.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:3.0", Timeout: 1})
+	if len(job.Services) != 1 || job.Services[0].ServiceID != green.Id {
+		t.Errorf("expected only the green service to be upgraded, got %+v", job.Services)
+	}
+
+	if err := updater.cleanupBlueGreen(entry); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.removed) != 1 || updater.blueGreen.get("1s1") != nil {
+		t.Errorf("expected blue service to be removed")
+	}
+}
+
+func Test_blueGreenPersisted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bluegreen")
+	defer os.RemoveAll(dir)
+	updater, service := newTestUpdater(testService(map[string]interface{}{strategyLabel: StrategyBlueGreen}))
+	var err error
+	if updater.blueGreen, err = openBlueGreen(dir); err != nil {
+		t.Fatal(err)
+	}
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	if job.Status != JobSucceeded {
+		t.Fatalf("unexpected job %+v", job.Services[0])
+	}
+
+	restarted, _ := newTestUpdater()
+	restarted.service = service
+	if restarted.blueGreen, err = openBlueGreen(dir); err != nil {
+		t.Fatal(err)
+	}
+	entry := restarted.blueGreen.get("1s1")
+	if entry == nil || entry.GreenID != service.services[1].Id {
+		t.Fatalf("expected the blue service to be loaded, got %+v", entry)
+	}
+	job = restarted.jobStore.create("myorg/api:3.0")
+	restarted.upgradeService(job, UpdateCommand{Image: "myorg/api:3.0", Timeout: 1})
+	if len(job.Services) != 1 || job.Services[0].ServiceID != entry.GreenID {
+		t.Errorf("expected the blue service to be skipped after a restart, got %+v", job.Services)
+	}
+
+	if err := restarted.cleanupBlueGreen(entry); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, _ := openBlueGreen(dir); reopened.get("1s1") != nil {
+		t.Errorf("expected the cleanup to be saved, got %+v", reopened.list())
+	}
+}
+
+func Test_upgradeBlueGreenUnconfirmed(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{strategyLabel: StrategyBlueGreen}))
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Timeout: 1})
+
+	if job.Services[0].Status != ServiceUpgraded {
+		t.Fatalf("unexpected job %+v", job.Services[0])
+	}
+	entry := updater.blueGreen.get("1s1")
+	if entry == nil || entry.GreenID != service.services[1].Id {
+		t.Fatalf("expected the unconfirmed blue service to be kept, got %+v", entry)
+	}
+	if err := updater.rollbackBlueGreen(entry); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.rolledBack) != 1 || len(service.removed) != 1 || service.removed[0] != entry.GreenID {
+		t.Errorf("expected the upgrade to be rolled back and green removed, got %v %v", service.rolledBack, service.removed)
+	}
+}
+
+func Test_upgradeBlueGreenFinishFails(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{strategyLabel: StrategyBlueGreen}))
+	updater.Config.FailurePolicy = FailurePolicyRollback
+	service.finishErr = map[string]error{"1s1": fmt.Errorf("finish failed")}
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if job.Status != JobFailed || job.Services[0].Status != ServiceRolledBack {
+		t.Fatalf("expected the upgrade to be rolled back, got %+v", job.Services[0])
+	}
+	if len(service.rolledBack) != 1 || len(service.removed) != 1 || service.removed[0] != service.services[1].Id {
+		t.Errorf("expected blue to be rolled back and green removed, got %v %v", service.rolledBack, service.removed)
+	}
+	if updater.blueGreen.get("1s1") != nil {
+		t.Errorf("expected no blue service to be kept")
+	}
+}
+
+func Test_cleanupBlueGreenRemoved(t *testing.T) {
+	updater, service := newTestUpdater()
+	entry := &BlueGreen{BlueID: "1s9", Blue: "api", GreenID: "1s10", Green: "api-2-0"}
+	updater.blueGreen.put(entry)
+
+	if err := updater.cleanupBlueGreen(entry); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.removed) != 0 || updater.blueGreen.get("1s9") != nil {
+		t.Errorf("expected the removed blue service to be dropped")
+	}
+	if _, err := updater.waitForState("1s9", "active", time.Millisecond); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+const deployUsage = "Usage: `/deploy <image>:<tag> to <environment>`, `/deploy status <service>` or `/deploy rollback <service> in <environment>`"
+
+// parseSlackUsers parses `id:token name` pairs mapping Slack user and channel ids to API tokens
+func parseSlackUsers(values []string) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid Slack user %s, expected id:token name", value)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, nil
+}
+
+// slackToken returns the API token mapped to the Slack user, or else to the channel, and checks its scope.
+// Without configured tokens every Slack user is allowed and no token is returned.
+func (s *ServiceUpdater) slackToken(userID string, channelID string, scope string) (*APIToken, error) {
+	if len(s.Config.APITokens) == 0 {
+		return nil, nil
+	}
+	name, ok := s.Config.SlackUsers[userID]
+	if !ok {
+		name, ok = s.Config.SlackUsers[channelID]
+	}
+	if ok {
+		for i := range s.Config.APITokens {
+			token := &s.Config.APITokens[i]
+			if token.Name != name {
+				continue
+			}
+			if !token.allows(scope) {
+				return nil, fmt.Errorf("You are not allowed to %s", scope)
+			}
+			return token, nil
+		}
+	}
+	return nil, fmt.Errorf("You are not allowed to use the updater")
+}
+
+// repository returns the image without the docker: prefix and the tag
+func repository(image string) string {
+	image = strings.TrimPrefix(image, "docker:")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+// matchesName reports whether the service is called name or runs an image called name
+func matchesName(svc client.Service, name string) bool {
+	if svc.Name == name {
+		return true
+	}
+	image := repository(svc.LaunchConfig.ImageUuid)
+	return image[strings.LastIndex(image, "/")+1:] == name
+}
+
+// resolveImage completes a short image reference such as `api:1.4.2` with the repository of the
+// managed services in the environment called or running `api`
+func (s *ServiceUpdater) resolveImage(ref string, env string) (string, error) {
+	ref = strings.TrimPrefix(ref, "docker:")
+	i := strings.LastIndex(ref, ":")
+	if strings.Contains(ref, "/") || i < 0 {
+		return ref, nil
+	}
+	name, tag := ref[:i], ref[i+1:]
+	managed, err := s.managedServices()
+	if err != nil {
+		return "", err
+	}
+	var found string
+	for _, m := range managed {
+		if m.Environment != env || !matchesName(m.Service, name) {
+			continue
+		}
+		image := repository(m.Service.LaunchConfig.ImageUuid)
+		if found != "" && found != image {
+			return "", fmt.Errorf("`%s` is ambiguous in %s: %s and %s", name, env, found, image)
+		}
+		found = image
+	}
+	if found == "" {
+		return "", fmt.Errorf("No managed service `%s` in %s", name, env)
+	}
+	return fmt.Sprintf("%s:%s", found, tag), nil
+}
+
+// slashCommand handles the `/deploy` Slack slash command
+func (s *ServiceUpdater) slashCommand(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	values, ok := s.readSlackRequest(w, r)
+	if !ok {
+		return
+	}
+	args := strings.Fields(values.Get("text"))
+	userID, channelID, user := values.Get("user_id"), values.Get("channel_id"), values.Get("user_name")
+	reply := func(responseType string, text string) {
+		sendJSON(w, map[string]string{"response_type": responseType, "text": text}, 200)
+	}
+	var scope string
+	switch {
+	case len(args) == 2 && args[0] == "status":
+		scope = ScopeRead
+	case len(args) == 4 && args[0] == "rollback" && args[2] == "in":
+		scope = ScopeAdmin
+	case len(args) == 3 && args[1] == "to":
+		scope = ScopeUpgrade
+	default:
+		reply("ephemeral", deployUsage)
+		return
+	}
+	token, err := s.slackToken(userID, channelID, scope)
+	if err != nil {
+		s.audit.add(AuditAuthFailure, fmt.Sprintf("slack:%s", user), map[string]interface{}{"command": values.Get("text"), "reason": err.Error()})
+		reply("ephemeral", err.Error())
+		return
+	}
+	env := args[len(args)-1]
+	if scope != ScopeRead {
+		if err := token.mayUse(scope, env); err != nil {
+			s.audit.add(AuditAuthFailure, fmt.Sprintf("slack:%s", user), map[string]interface{}{"command": values.Get("text"), "reason": err.Error()})
+			reply("ephemeral", err.Error())
+			return
+		}
+	}
+	s.log.infof("Slack user %s ran /deploy %s", user, values.Get("text"))
+	if scope == ScopeAdmin {
+		s.audit.add(AuditTrigger, fmt.Sprintf("slack:%s", user), map[string]interface{}{"command": values.Get("text")})
+	}
+
+	switch scope {
+	case ScopeRead:
+		text, err := s.deployStatus(args[1])
+		if err != nil {
+			reply("ephemeral", err.Error())
+			return
+		}
+		reply("ephemeral", text)
+	case ScopeAdmin:
+		reply("in_channel", fmt.Sprintf("<@%s> is rolling back `%s` in %s", userID, args[1], env))
+		responseURL := values.Get("response_url")
+		go func() {
+			err := s.rollbackNamed(args[1], env)
+			s.auditRollback(fmt.Sprintf("slack:%s", user), map[string]interface{}{"service": args[1], "environment": env}, err)
+			if err != nil {
+				s.slackReply(responseURL, "in_channel", fmt.Sprintf("Unable to roll back `%s` in %s: %s", args[1], env, err))
+				return
+			}
+			s.slackReply(responseURL, "in_channel", fmt.Sprintf("Rolled back `%s` in %s", args[1], env))
+		}()
+	case ScopeUpgrade:
+		image, err := s.resolveImage(args[0], env)
+		if err != nil {
+			s.metrics.triggerReceived(TriggerSlack, "rejected")
+			reply("ephemeral", err.Error())
+			return
+		}
+		s.metrics.triggerReceived(TriggerSlack, "accepted")
+		command := UpdateCommand{Image: image, Confirm: true, Timeout: 30, Environments: []string{env}}
+		job := s.jobStore.create(command.Image)
+		job.update(func() {
+			job.Environments = command.Environments
+			job.Trigger = TriggerSlack
+			job.Caller = fmt.Sprintf("slack:%s", user)
+			job.token = token
+		})
+		s.auditJob(job)
+		go s.runJob(job, command)
+		reply("in_channel", fmt.Sprintf("<@%s> started job `%s` upgrading `%s` in %s", userID, job.ID, image, env))
+	}
+}
+
+// deployStatus describes the managed services called or running name, and the jobs upgrading them
+func (s *ServiceUpdater) deployStatus(name string) (string, error) {
+	managed, err := s.managedServices()
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, m := range managed {
+		if !matchesName(m.Service, name) {
+			continue
+		}
+		state := m.Service.State
+		if m.Service.HealthState != "" {
+			state = fmt.Sprintf("%s/%s", state, m.Service.HealthState)
+		}
+		lines = append(lines, fmt.Sprintf("`%s` in %s: `%s` (%s)", m.Service.Name, m.Environment,
+			strings.TrimPrefix(m.Service.LaunchConfig.ImageUuid, "docker:"), state))
+		for _, job := range s.jobStore.list() {
+			job.mu.Lock()
+			for _, target := range job.Services {
+				if target.ServiceID == m.Service.Id && job.Status != JobSucceeded && job.Status != JobFailed {
+					lines = append(lines, fmt.Sprintf("    job `%s` %s to `%s`", job.ID, target.Status, target.ToImage))
+				}
+			}
+			job.mu.Unlock()
+		}
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("No managed service `%s`", name)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// rollbackNamed rolls back the service called name in the environment. Blue/green upgrades are rolled
+// back to the kept service, other upgrades only while they are not finished.
+func (s *ServiceUpdater) rollbackNamed(name string, env string) error {
+	for _, entry := range s.blueGreen.list() {
+		if entry.Environment == env && (entry.Blue == name || entry.Green == name) {
+			return s.rollbackBlueGreen(entry)
+		}
+	}
+	managed, err := s.managedServices()
+	if err != nil {
+		return err
+	}
+	for _, m := range managed {
+		if m.Environment != env || m.Service.Name != name {
+			continue
+		}
+		switch m.Service.State {
+		case "upgrading", "upgraded":
+			return s.rollbackUpgrade(m.Service)
+		default:
+			return fmt.Errorf("the upgrade of `%s` is already finished (%s), trigger the previous image instead", name, m.Service.State)
+		}
+	}
+	return fmt.Errorf("No managed service `%s` in %s", name, env)
+}
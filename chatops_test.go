@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func slashCommand(updater *ServiceUpdater, userID string, text string) map[string]string {
+	body := url.Values{"command": {"/deploy"}, "text": {text}, "user_id": {userID}, "user_name": {"alice"}, "channel_id": {"C1"}}.Encode()
+	w := httptest.NewRecorder()
+	updater.slashCommand(w, signedSlackRequest("signing", "/slack/commands", body))
+	var reply map[string]string
+	json.NewDecoder(w.Body).Decode(&reply)
+	return reply
+}
+
+func Test_slashCommandDeploy(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	updater.Config.SlackSigningSecret = "signing"
+
+	reply := slashCommand(updater, "U1", "api:2.0 to dev")
+	if reply["response_type"] != "in_channel" || !strings.Contains(reply["text"], "myorg/api:2.0") {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	job := updater.jobStore.list()[0]
+	waitForJob(t, job)
+	if job.Status != JobSucceeded || len(service.finished) != 1 {
+		t.Errorf("expected api to be upgraded, got %s", job.Status)
+	}
+
+	if reply := slashCommand(updater, "U1", "status api"); !strings.Contains(reply["text"], "`api` in dev: `myorg/api:1.0`") {
+		t.Errorf("unexpected status %v", reply)
+	}
+	if reply := slashCommand(updater, "U1", "api:2.0 to nowhere"); !strings.Contains(reply["text"], "No managed service") {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	if reply := slashCommand(updater, "U1", "please"); reply["text"] != deployUsage {
+		t.Errorf("expected usage, got %v", reply)
+	}
+}
+
+func Test_slashCommandPermissions(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	updater.Config.SlackSigningSecret = "signing"
+	updater.Config.APITokens = []APIToken{
+		{Name: "oncall", Token: "a", Scopes: []string{ScopeRead, ScopeUpgrade}, Environments: "^qa$"},
+		{Name: "viewers", Token: "b", Scopes: []string{ScopeRead}},
+	}
+	updater.Config.SlackUsers, _ = parseSlackUsers([]string{"U1:oncall", "C1:viewers"})
+
+	if reply := slashCommand(updater, "U1", "api:2.0 to dev"); !strings.Contains(reply["text"], "Token oncall may not upgrade in dev") {
+		t.Errorf("expected environment to be denied, got %v", reply)
+	}
+	if reply := slashCommand(updater, "U2", "api:2.0 to dev"); !strings.Contains(reply["text"], "not allowed to upgrade") {
+		t.Errorf("expected channel mapping to deny upgrades, got %v", reply)
+	}
+	if reply := slashCommand(updater, "U2", "status api"); !strings.Contains(reply["text"], "`api` in dev") {
+		t.Errorf("expected channel mapping to allow status, got %v", reply)
+	}
+	if len(service.upgrades) != 0 {
+		t.Error("expected no upgrade")
+	}
+}
+
+func Test_rollbackNamed(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	service.services[0].State = "upgraded"
+	if err := updater.rollbackNamed("api", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.rolledBack) != 1 {
+		t.Error("expected unfinished upgrade to be rolled back")
+	}
+	service.services[0].State = "active"
+	if err := updater.rollbackNamed("api", "dev"); err == nil {
+		t.Error("expected finished upgrade not to be rolled back")
+	}
+}
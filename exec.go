@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+const (
+	verifyExecLabel           = "autoupdate.verify.exec"
+	verifyExecContainersLabel = "autoupdate.verify.exec_containers"
+	verifyExecTimeoutLabel    = "autoupdate.verify.exec_timeout"
+
+	exitMarker = "__AUTOUPDATE_EXIT__="
+)
+
+// exitPattern matches the exit status only once its line is complete, as the output may
+// arrive split at any point
+var exitPattern = regexp.MustCompile(regexp.QuoteMeta(exitMarker) + `(\d+)\r?\n`)
+
+// ExecCheck is an in-container command verification declared through service labels
+type ExecCheck struct {
+	Command    string
+	Containers int
+	Timeout    time.Duration
+}
+
+func execCheckFromLabels(labels map[string]interface{}) (*ExecCheck, error) {
+	command, ok := label(labels, verifyExecLabel)
+	if !ok || command == "" {
+		return nil, nil
+	}
+	check := &ExecCheck{Command: command}
+	var err error
+	if check.Containers, err = labelInt(labels, verifyExecContainersLabel, 1); err != nil {
+		return nil, err
+	}
+	timeout, err := labelInt(labels, verifyExecTimeoutLabel, 30)
+	if err != nil {
+		return nil, err
+	}
+	check.Timeout = time.Duration(timeout) * time.Second
+	return check, nil
+}
+
+// newContainers returns the running containers of the service that use the upgraded image.
+// Matching the upgraded image rather than the primary image also finds the new containers of
+// an upgrade that only changed sidekicks, whose primary containers keep their image.
+func (s *ServiceUpdater) newContainers(service client.Service, image string) ([]client.Container, error) {
+	instances := &client.ContainerCollection{}
+	if err := s.base.GetLink(service.Resource, "instances", instances); err != nil {
+		return nil, err
+	}
+	containers := []client.Container{}
+	for _, c := range instances.Data {
+		if c.State == "running" && c.ImageUuid == image {
+			containers = append(containers, c)
+		}
+	}
+	return containers, nil
+}
+
+func (s *ServiceUpdater) verifyExec(service client.Service, image string, check *ExecCheck) error {
+	containers, err := s.newContainers(service, image)
+	if err != nil {
+		return err
+	}
+	if len(containers) == 0 {
+		return fmt.Errorf("No running containers found for %s", service.Name)
+	}
+	if check.Containers > 0 && check.Containers < len(containers) {
+		containers = containers[:check.Containers]
+	}
+	for _, c := range containers {
+		code, err := s.execute(c, check)
+		if err != nil {
+			return fmt.Errorf("Unable to run %q in %s: %s", check.Command, c.Name, err)
+		}
+		if code != 0 {
+			return fmt.Errorf("Command %q in %s exited with %d", check.Command, c.Name, code)
+		}
+	}
+	return nil
+}
+
+// execute runs the check command in the container and returns its exit code.
+// Rancher only streams output over the exec websocket, so the command is
+// wrapped in a shell that echoes the exit status as the last line.
+func (s *ServiceUpdater) execute(container client.Container, check *ExecCheck) (int, error) {
+	access, err := s.container.ActionExecute(&container, &client.ContainerExec{
+		AttachStdin:  false,
+		AttachStdout: true,
+		Command:      []string{"/bin/sh", "-c", fmt.Sprintf("%s; echo %s$?", check.Command, exitMarker)},
+		Tty:          false,
+	})
+	if err != nil {
+		return -1, err
+	}
+	conn, _, err := s.base.Websocket(fmt.Sprintf("%s?token=%s", access.Url, access.Token), nil)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	var output []byte
+	var readErr error
+	conn.SetReadDeadline(time.Now().Add(check.Timeout))
+	for !exitPattern.Match(output) {
+		var message []byte
+		if _, message, readErr = conn.ReadMessage(); readErr != nil {
+			break
+		}
+		decoded, err := base64.StdEncoding.DecodeString(string(message))
+		if err != nil {
+			decoded = message
+		}
+		output = append(output, decoded...)
+	}
+	s.log.debugf("Output of %q in %s: %s", check.Command, container.Name, string(output))
+	match := exitPattern.FindSubmatch(output)
+	if match == nil {
+		return -1, fmt.Errorf("No exit status received: %v", readErr)
+	}
+	return strconv.Atoi(string(match[1]))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/go-rancher/client"
+)
+
+type mockContainer struct {
+	url      string
+	commands [][]string
+}
+
+func (m *mockContainer) ActionExecute(container *client.Container, exec *client.ContainerExec) (*client.HostAccess, error) {
+	m.commands = append(m.commands, exec.Command)
+	return &client.HostAccess{Url: m.url, Token: "token"}, nil
+}
+
+type mockBase struct {
+	containers []client.Container
+}
+
+func (m *mockBase) GetLink(resource client.Resource, link string, respObject interface{}) error {
+	respObject.(*client.ContainerCollection).Data = m.containers
+	return nil
+}
+
+func (m *mockBase) Websocket(url string, headers map[string][]string) (*websocket.Conn, *http.Response, error) {
+	return websocket.DefaultDialer.Dial(url, http.Header(headers))
+}
+
+// fakeExecServer stands in for the Rancher exec websocket, streaming base64 encoded output
+func fakeExecServer(t *testing.T, output ...string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "token" {
+			t.Errorf("expected exec token, got %s", r.URL.RawQuery)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for _, o := range output {
+			conn.WriteMessage(websocket.TextMessage, []byte(base64.StdEncoding.EncodeToString([]byte(o))))
+		}
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+}
+
+func newExecUpdater(url string) (*ServiceUpdater, *mockContainer, client.Service) {
+	image := "docker:worker:2.0"
+	container := &mockContainer{url: "ws" + strings.TrimPrefix(url, "http")}
+	updater := &ServiceUpdater{
+		Config:    &Config{},
+		container: container,
+		base: &mockBase{containers: []client.Container{
+			{Name: "old", State: "stopped", ImageUuid: "docker:worker:1.0"},
+			{Name: "new-1", State: "running", ImageUuid: image},
+			{Name: "new-2", State: "running", ImageUuid: image},
+		}},
+	}
+	service := client.Service{
+		Name: "worker",
+		LaunchConfig: &client.LaunchConfig{
+			ImageUuid: image,
+			Labels: map[string]interface{}{
+				verifyExecLabel: "/app/selfcheck",
+			},
+		},
+	}
+	return updater, container, service
+}
+
+func Test_verifyExec(t *testing.T) {
+	server := fakeExecServer(t, "checking queue\n", exitMarker+"0\n")
+	defer server.Close()
+
+	updater, container, service := newExecUpdater(server.URL)
+	if err := updater.verifyService(service, service.LaunchConfig.ImageUuid); err != nil {
+		t.Fatalf("expected verification to pass: %s", err)
+	}
+	if len(container.commands) != 1 {
+		t.Fatalf("expected command in 1 container, got %d", len(container.commands))
+	}
+	if cmd := container.commands[0]; cmd[2] != "/app/selfcheck; echo "+exitMarker+"$?" {
+		t.Errorf("unexpected command %v", cmd)
+	}
+
+	service.LaunchConfig.Labels[verifyExecContainersLabel] = "0"
+	container.commands = nil
+	if err := updater.verifyService(service, service.LaunchConfig.ImageUuid); err != nil {
+		t.Fatal(err)
+	}
+	if len(container.commands) != 2 {
+		t.Errorf("expected command in all new containers, got %d", len(container.commands))
+	}
+}
+
+func Test_verifyExecFailure(t *testing.T) {
+	server := fakeExecServer(t, "queue unreachable\n"+exitMarker+"3\n")
+	defer server.Close()
+
+	updater, _, service := newExecUpdater(server.URL)
+	err := updater.verifyService(service, service.LaunchConfig.ImageUuid)
+	if err == nil || !strings.Contains(err.Error(), "exited with 3") {
+		t.Fatalf("expected exit code failure, got %v", err)
+	}
+}
+
+func Test_verifyExecChunkedExitStatus(t *testing.T) {
+	server := fakeExecServer(t, "queue unreachable\n__AUTOUPDATE_", "EXIT__=1", "2", "\n")
+	defer server.Close()
+
+	updater, _, service := newExecUpdater(server.URL)
+	err := updater.verifyService(service, service.LaunchConfig.ImageUuid)
+	if err == nil || !strings.Contains(err.Error(), "exited with 12") {
+		t.Fatalf("expected the exit code split across messages to be read in full, got %v", err)
+	}
+}
+
+func Test_verifyExecNoExitStatus(t *testing.T) {
+	server := fakeExecServer(t, "sh: /app/selfcheck: not found\n")
+	defer server.Close()
+
+	updater, _, service := newExecUpdater(server.URL)
+	if err := updater.verifyService(service, service.LaunchConfig.ImageUuid); err == nil {
+		t.Fatal("expected missing exit status to fail")
+	}
+}
+
+func Test_newContainersSidekick(t *testing.T) {
+	updater := &ServiceUpdater{base: &mockBase{containers: []client.Container{
+		{Name: "api-1", State: "running", ImageUuid: "docker:myorg/api:1.0"},
+		{Name: "api-worker-1", State: "running", ImageUuid: "docker:worker:1.0"},
+		{Name: "api-worker-2", State: "running", ImageUuid: "docker:worker:2.0"},
+	}}}
+	service := client.Service{Name: "api", LaunchConfig: &client.LaunchConfig{ImageUuid: "docker:myorg/api:1.0"}}
+	containers, err := updater.newContainers(service, "docker:worker:2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].Name != "api-worker-2" {
+		t.Errorf("expected only the upgraded sidekick container, got %+v", containers)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+	"github.com/rancher/go-rancher/client"
+)
+
+const (
+	//CheckOK is the status of a passing readiness check
+	CheckOK = "ok"
+	//CheckFailed is the status of a failing readiness check
+	CheckFailed = "failed"
+
+	rancherCheckTTL = 30 * time.Second
+	jobStoreTimeout = time.Second
+)
+
+// Check is the result of one readiness check
+type Check struct {
+	Name    string      `json:"name"`
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Checked time.Time   `json:"checked"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Readiness caches the result of the Rancher check, so that frequent probes do not load the Rancher API
+type Readiness struct {
+	mu      sync.Mutex
+	rancher *Check
+}
+
+func check(name string, err error, details interface{}) Check {
+	c := Check{Name: name, Status: CheckOK, Checked: time.Now().UTC(), Details: details}
+	if err != nil {
+		c.Status, c.Message = CheckFailed, err.Error()
+	}
+	return c
+}
+
+// checkRancher lists one environment to verify that the Rancher API is reachable and the keys
+// are valid. The result is cached for rancherCheckTTL.
+func (s *ServiceUpdater) checkRancher(now time.Time) Check {
+	s.readiness.mu.Lock()
+	defer s.readiness.mu.Unlock()
+	if c := s.readiness.rancher; c != nil && now.Sub(c.Checked) < rancherCheckTTL {
+		return *c
+	}
+	_, err := s.account.List(&client.ListOpts{Filters: map[string]interface{}{"limit": 1}})
+	if err != nil {
+		err = fmt.Errorf("Rancher API at %s is not available: %s", s.Config.CattleURL, err)
+	}
+	c := check("rancher", err, nil)
+	c.Checked = now.UTC()
+	s.readiness.rancher = &c
+	return c
+}
+
+// checkJobStore verifies that jobs can be stored: the job store is not stuck, and the data
+// directory is writable if one is configured
+func (s *ServiceUpdater) checkJobStore() Check {
+	locked := make(chan struct{})
+	go func() {
+		s.jobStore.mu.Lock()
+		s.jobStore.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(jobStoreTimeout):
+		return check("job_store", fmt.Errorf("Job store is locked for more than %s", jobStoreTimeout), nil)
+	}
+	if s.Config.DataDir == "" {
+		return check("job_store", nil, nil)
+	}
+	probe, err := ioutil.TempFile(s.Config.DataDir, ".readyz")
+	if err != nil {
+		return check("job_store", fmt.Errorf("Data directory %s is not writable: %s", s.Config.DataDir, err), nil)
+	}
+	probe.Close()
+	return check("job_store", os.Remove(probe.Name()), map[string]string{"data_dir": s.Config.DataDir})
+}
+
+// checkQueue reports the queued upgrades, failing once the queue holds the configured limit
+func (s *ServiceUpdater) checkQueue() Check {
+	queued, limit := s.queue.len(), s.Config.QueueLimit
+	var err error
+	if limit > 0 && queued >= limit {
+		err = fmt.Errorf("Queue is saturated with %d upgrades", queued)
+	}
+	return check("queue", err, map[string]int{"queued": queued, "limit": limit})
+}
+
+// healthzHandler handles GET /healthz, reporting that the process is alive
+func (s *ServiceUpdater) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	sendJSON(w, map[string]string{"status": CheckOK}, 200)
+}
+
+// readyzHandler handles GET /readyz, responding 503 if any check fails
+func (s *ServiceUpdater) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	s = s.traced(r)
+	checks := []Check{s.checkRancher(time.Now()), s.checkJobStore(), s.checkQueue()}
+	status, code := CheckOK, 200
+	for _, c := range checks {
+		if c.Status != CheckOK {
+			status, code = CheckFailed, 503
+		}
+	}
+	sendJSON(w, map[string]interface{}{"status": status, "checks": checks}, code)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// failingAccount fails like Rancher with invalid keys
+type failingAccount struct {
+	calls int
+}
+
+func (a *failingAccount) List(opts *client.ListOpts) (*client.AccountCollection, error) {
+	a.calls++
+	return nil, fmt.Errorf("Bad response statusCode [401]. Status [401 Unauthorized]")
+}
+
+type readyResponse struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+func readyz(t *testing.T, updater *ServiceUpdater) (int, map[string]Check) {
+	w := httptest.NewRecorder()
+	updater.readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	var body readyResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	checks := make(map[string]Check)
+	for _, c := range body.Checks {
+		checks[c.Name] = c
+	}
+	if (w.Code == 200) != (body.Status == CheckOK) {
+		t.Errorf("unexpected status %s for code %d", body.Status, w.Code)
+	}
+	return w.Code, checks
+}
+
+func Test_healthz(t *testing.T) {
+	updater, _ := newTestUpdater()
+	w := httptest.NewRecorder()
+	updater.healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"status":"ok"}` {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_readyz(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "readyz")
+	defer os.RemoveAll(dir)
+	updater, _ := newTestUpdater()
+	updater.Config.DataDir = dir
+	updater.Config.QueueLimit = 1
+
+	code, checks := readyz(t, updater)
+	if code != 200 || len(checks) != 3 {
+		t.Fatalf("expected ready, got %d %+v", code, checks)
+	}
+	for _, name := range []string{"rancher", "job_store", "queue"} {
+		if checks[name].Status != CheckOK {
+			t.Errorf("expected %s to pass, got %+v", name, checks[name])
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("expected the probe file to be removed, got %v", files)
+	}
+
+	updater.queue.add(&queuedUpgrade{job: updater.jobStore.create("myorg/api:2.0")})
+	code, checks = readyz(t, updater)
+	if code != 503 || checks["queue"].Status != CheckFailed || checks["queue"].Message != "Queue is saturated with 1 upgrades" {
+		t.Errorf("expected a saturated queue, got %d %+v", code, checks["queue"])
+	}
+
+	updater.Config.DataDir = filepath.Join(dir, "missing")
+	if c := updater.checkJobStore(); c.Status != CheckFailed {
+		t.Errorf("expected a missing data directory to fail, got %+v", c)
+	}
+}
+
+func Test_readyzRancher(t *testing.T) {
+	updater, _ := newTestUpdater()
+	account := &failingAccount{}
+	updater.account = account
+
+	code, checks := readyz(t, updater)
+	if code != 503 || checks["rancher"].Status != CheckFailed {
+		t.Fatalf("expected Rancher to fail, got %d %+v", code, checks["rancher"])
+	}
+	readyz(t, updater)
+	if account.calls != 1 {
+		t.Errorf("expected the Rancher check to be cached, got %d calls", account.calls)
+	}
+
+	updater.account = &mockAccount{}
+	if c := updater.checkRancher(time.Now().Add(rancherCheckTTL)); c.Status != CheckOK {
+		t.Errorf("expected Rancher to be checked again, got %+v", c)
+	}
+}
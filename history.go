@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	//TriggerAPI is an upgrade triggered through POST /upgrade
+	TriggerAPI = "api"
+	//TriggerSlack is an upgrade triggered by the /deploy slash command
+	TriggerSlack = "slack"
+	//TriggerPromotion is an upgrade started by a promotion rule
+	TriggerPromotion = "promotion"
+
+	historyFile        = "history.jsonl"
+	maxHistory         = 10000
+	defaultHistoryPage = 100
+	maxHistoryPage     = 1000
+)
+
+// HistoryRecord is one upgrade attempt of a service
+type HistoryRecord struct {
+	JobID       string    `json:"job_id"`
+	Trigger     string    `json:"trigger"`
+	Caller      string    `json:"caller"`
+	ApprovedBy  string    `json:"approved_by,omitempty"`
+	ServiceID   string    `json:"service_id,omitempty"`
+	Service     string    `json:"service,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	StackID     string    `json:"stack_id,omitempty"`
+	FromImage   string    `json:"from_image,omitempty"`
+	ToImage     string    `json:"to_image"`
+	Strategy    string    `json:"strategy,omitempty"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Duration    float64   `json:"duration"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// HistoryFilter selects history records, empty fields matching everything
+type HistoryFilter struct {
+	Service     string
+	Environment string
+	Image       string
+	Outcome     string
+	Trigger     string
+	Caller      string
+	JobID       string
+	Since       time.Time
+	Until       time.Time
+}
+
+// HistoryStore keeps the most recent upgrade records in memory and appends every record to
+// history.jsonl in the data directory, if one is configured
+type HistoryStore struct {
+	mu      sync.Mutex
+	records []HistoryRecord
+	file    *os.File
+	log     *Logger
+}
+
+// openHistory loads the records of the data directory and opens its history file for appending.
+// Without a data directory the history is kept in memory only.
+func openHistory(dir string) (*HistoryStore, error) {
+	h := &HistoryStore{}
+	if dir == "" {
+		return h, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, historyFile)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Invalid record on line %d of %s: %s", line, path, err)
+		}
+		h.append(record)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	h.file = file
+	return h, nil
+}
+
+func (h *HistoryStore) append(record HistoryRecord) {
+	h.records = append(h.records, record)
+	if len(h.records) > maxHistory {
+		h.records = h.records[len(h.records)-maxHistory:]
+	}
+}
+
+// add records the upgrades and writes them to the history file
+func (h *HistoryStore) add(records ...HistoryRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, record := range records {
+		h.append(record)
+		if h.file == nil {
+			continue
+		}
+		line, _ := json.Marshal(record)
+		if _, err := h.file.Write(append(line, '\n')); err != nil {
+			h.log.errorf("Unable to write history: %s", err)
+		}
+	}
+}
+
+// matches reports whether the record is selected by the filter
+func (f HistoryFilter) matches(record HistoryRecord) bool {
+	switch {
+	case f.Service != "" && f.Service != record.Service && f.Service != record.ServiceID,
+		f.Environment != "" && f.Environment != record.Environment,
+		f.Outcome != "" && f.Outcome != record.Outcome,
+		f.Trigger != "" && f.Trigger != record.Trigger,
+		f.Caller != "" && f.Caller != record.Caller,
+		f.JobID != "" && f.JobID != record.JobID,
+		!f.Since.IsZero() && record.Finished.Before(f.Since),
+		!f.Until.IsZero() && !record.Finished.Before(f.Until):
+		return false
+	}
+	if f.Image != "" {
+		image := strings.TrimPrefix(f.Image, "docker:")
+		for _, candidate := range []string{record.FromImage, record.ToImage} {
+			candidate = strings.TrimPrefix(candidate, "docker:")
+			if image == candidate || image == repository(candidate) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// list returns the records selected by the filter, most recent first
+func (h *HistoryStore) list(filter HistoryFilter) []HistoryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := []HistoryRecord{}
+	for i := len(h.records) - 1; i >= 0; i-- {
+		if filter.matches(h.records[i]) {
+			records = append(records, h.records[i])
+		}
+	}
+	return records
+}
+
+// record adds the upgrades of a finished job to the history. A job that failed before any
+// service was upgraded, e.g. because it was rejected, is recorded once without a service.
+func (s *ServiceUpdater) record(job *Job) {
+	var records []HistoryRecord
+	now := time.Now().UTC()
+	job.update(func() {
+		base := HistoryRecord{JobID: job.ID, Trigger: job.Trigger, Caller: job.Caller, Finished: now}
+		if job.Approval != nil {
+			base.ApprovedBy = job.Approval.DecidedBy
+		}
+		for _, target := range job.Services {
+			if target.Finished == nil {
+				target.Finished = &now
+			}
+			record := base
+			record.ServiceID = target.ServiceID
+			record.Service = target.Service
+			record.Environment = target.Environment
+			record.StackID = target.StackID
+			record.FromImage = target.FromImage
+			record.ToImage = target.ToImage
+			record.Strategy = target.Strategy
+			record.Started = job.Created
+			if target.Started != nil {
+				record.Started = *target.Started
+			}
+			record.Finished = *target.Finished
+			record.Outcome = target.Status
+			record.Error = target.Error
+			if record.Error == "" && target.Status != ServiceSucceeded && target.Status != ServiceUpgraded {
+				record.Error = job.Error
+			}
+			records = append(records, record)
+		}
+		if len(job.Services) == 0 && job.Error != "" {
+			record := base
+			record.ToImage = job.Image
+			if job.Release != "" {
+				record.ToImage = strings.Join(job.Images, ",")
+			}
+			record.Started = job.Created
+			record.Outcome = JobFailed
+			record.Error = job.Error
+			records = append(records, record)
+		}
+	})
+	for i := range records {
+		records[i].Duration = records[i].Finished.Sub(records[i].Started).Seconds()
+	}
+	for _, record := range records {
+		if record.ServiceID != "" {
+			tags := metricTags{Environment: record.Environment, Stack: record.StackID, Service: record.Service, Image: strings.TrimPrefix(record.ToImage, "docker:")}
+			s.metrics.upgradeFinished(tags, record.Outcome, record.Finished)
+		}
+	}
+	s.history.add(records...)
+	for _, record := range records {
+		s.audit.add(AuditUpgrade, record.Caller, map[string]interface{}{
+			"job": record.JobID, "trigger": record.Trigger, "approved_by": record.ApprovedBy, "service": record.Service,
+			"service_id": record.ServiceID, "environment": record.Environment, "from_image": record.FromImage,
+			"to_image": record.ToImage, "outcome": record.Outcome, "error": record.Error,
+		})
+	}
+}
+
+// historyFilter reads the filter of a /history request
+func historyFilter(r *http.Request) (HistoryFilter, error) {
+	query := r.URL.Query()
+	filter := HistoryFilter{
+		Service:     query.Get("service"),
+		Environment: query.Get("environment"),
+		Image:       query.Get("image"),
+		Outcome:     query.Get("outcome"),
+		Trigger:     query.Get("trigger"),
+		Caller:      query.Get("caller"),
+		JobID:       query.Get("job"),
+	}
+	for key, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(key); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("Invalid %s, expected an RFC 3339 time: %s", key, err)
+			}
+			*t = parsed
+		}
+	}
+	return filter, nil
+}
+
+// queryInt reads a non-negative integer query parameter
+func queryInt(r *http.Request, key string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("Invalid %s %s", key, value)
+	}
+	return i, nil
+}
+
+// historyHandler handles GET /history, which returns a page of the matching records, most recent
+// first, and GET /history/export, which streams all of them as JSON lines, oldest first
+func (s *ServiceUpdater) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	filter, err := historyFilter(r)
+	if err != nil {
+		utils.SendError(w, err.Error(), 400)
+		return
+	}
+	records := s.history.list(filter)
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/history"), "/") {
+	case "":
+	case "export":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.jsonl"`)
+		encoder := json.NewEncoder(w)
+		for i := len(records) - 1; i >= 0; i-- {
+			encoder.Encode(records[i])
+		}
+		return
+	default:
+		utils.SendError(w, "Not found", 404)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultHistoryPage)
+	if err != nil {
+		utils.SendError(w, err.Error(), 400)
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		utils.SendError(w, err.Error(), 400)
+		return
+	}
+	if limit == 0 || limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+	total := len(records)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		records = records[offset : offset+limit]
+	} else {
+		records = records[offset:]
+	}
+	sendJSON(w, map[string]interface{}{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"records": records,
+	}, 200)
+}
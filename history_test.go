@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func Test_history(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	updater, _ := newTestUpdater(testService(map[string]interface{}{}))
+	if updater.history, err = openHistory(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	job := updater.jobStore.create("myorg/api:2.0")
+	job.update(func() { job.Trigger, job.Caller = TriggerAPI, "ci" })
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	rejected := updater.jobStore.create("myorg/api:3.0")
+	rejected.update(func() {
+		rejected.Trigger, rejected.Caller, rejected.Error = TriggerSlack, "slack:alice", "Rejected by bob"
+	})
+	updater.record(rejected)
+
+	records := updater.history.list(HistoryFilter{})
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	r := records[1]
+	if r.JobID != job.ID || r.Trigger != TriggerAPI || r.Caller != "ci" || r.Service != "api" || r.Environment != "dev" ||
+		r.FromImage != "docker:myorg/api:1.0" || r.ToImage != "docker:myorg/api:2.0" || r.Strategy != StrategyRolling ||
+		r.Outcome != ServiceSucceeded || r.Finished.Before(r.Started) {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r := records[0]; r.Outcome != JobFailed || r.Error != "Rejected by bob" || r.Service != "" || r.ToImage != "myorg/api:3.0" {
+		t.Errorf("unexpected record %+v", r)
+	}
+
+	reopened, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded := reopened.list(HistoryFilter{}); len(loaded) != 2 || loaded[1].JobID != job.ID {
+		t.Errorf("expected the history to be loaded, got %+v", loaded)
+	}
+
+	for query, expected := range map[string]int{
+		"":                           2,
+		"service=api":                1,
+		"service=1s1":                1,
+		"image=myorg/api":            2,
+		"image=myorg/api:1.0":        1,
+		"trigger=slack":              1,
+		"caller=ci&outcome=failed":   0,
+		"since=2000-01-01T00:00:00Z": 2,
+		"until=2000-01-01T00:00:00Z": 0,
+		"limit=1":                    1,
+		"offset=1":                   1,
+		"offset=5":                   0,
+	} {
+		w := httptest.NewRecorder()
+		updater.historyHandler(w, httptest.NewRequest("GET", "/history?"+query, nil))
+		var page struct {
+			Total   int             `json:"total"`
+			Records []HistoryRecord `json:"records"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil || len(page.Records) != expected {
+			t.Errorf("%s: expected %d records, got %d %v", query, expected, len(page.Records), err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	updater.historyHandler(w, httptest.NewRequest("GET", "/history/export", nil))
+	scanner := bufio.NewScanner(w.Body)
+	var exported []HistoryRecord
+	for scanner.Scan() {
+		var record HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		exported = append(exported, record)
+	}
+	if len(exported) != 2 || exported[0].JobID != job.ID {
+		t.Errorf("expected the export to be oldest first, got %+v", exported)
+	}
+
+	w = httptest.NewRecorder()
+	updater.historyHandler(w, httptest.NewRequest("GET", "/history?since=yesterday", nil))
+	if w.Code != 400 {
+		t.Errorf("expected invalid since to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const holdsFile = "holds.json"
+
+// Hold keeps a service at its current version until it is released or expires
+type Hold struct {
+	ServiceID string     `json:"service_id"`
+	Service   string     `json:"service"`
+	Reason    string     `json:"reason,omitempty"`
+	By        string     `json:"by"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// HoldStore keeps the holds by service id and saves them to holds.json in the data directory,
+// if one is configured
+type HoldStore struct {
+	mu    sync.Mutex
+	holds map[string]*Hold
+	path  string
+}
+
+// openHolds loads the holds saved in the data directory. Without a data directory the holds
+// are kept in memory only.
+func openHolds(dir string) (*HoldStore, error) {
+	hs := &HoldStore{holds: make(map[string]*Hold)}
+	if dir == "" {
+		return hs, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	hs.path = filepath.Join(dir, holdsFile)
+	content, err := ioutil.ReadFile(hs.path)
+	if os.IsNotExist(err) {
+		return hs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var holds []*Hold
+	if err := json.Unmarshal(content, &holds); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", hs.path, err)
+	}
+	for _, h := range holds {
+		hs.holds[h.ServiceID] = h
+	}
+	return hs, nil
+}
+
+func (h *Hold) expired(now time.Time) bool {
+	return h.Expires != nil && !h.Expires.After(now)
+}
+
+// reason describes the hold for plan and job output
+func (h *Hold) reason() string {
+	reason := fmt.Sprintf("Held by %s", h.By)
+	if h.Expires != nil {
+		reason = fmt.Sprintf("%s until %s", reason, h.Expires.Format(time.RFC3339))
+	}
+	if h.Reason != "" {
+		reason = fmt.Sprintf("%s: %s", reason, h.Reason)
+	}
+	return reason
+}
+
+// save writes the holds to the holds file, replacing it atomically. It must be called with the lock held.
+func (hs *HoldStore) save() error {
+	if hs.path == "" {
+		return nil
+	}
+	holds := make([]*Hold, 0, len(hs.holds))
+	for _, h := range hs.holds {
+		holds = append(holds, h)
+	}
+	sort.Slice(holds, func(i, k int) bool { return holds[i].ServiceID < holds[k].ServiceID })
+	content, err := json.MarshalIndent(holds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := hs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, hs.path)
+}
+
+// prune removes the expired holds. It must be called with the lock held.
+func (hs *HoldStore) prune(now time.Time) {
+	for id, h := range hs.holds {
+		if h.expired(now) {
+			delete(hs.holds, id)
+		}
+	}
+}
+
+// add holds a service, replacing its previous hold
+func (hs *HoldStore) add(h *Hold) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.prune(time.Now())
+	hs.holds[h.ServiceID] = h
+	return hs.save()
+}
+
+// remove releases a service and reports whether it was held
+func (hs *HoldStore) remove(serviceID string) (bool, error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.prune(time.Now())
+	if _, ok := hs.holds[serviceID]; !ok {
+		return false, nil
+	}
+	delete(hs.holds, serviceID)
+	return true, hs.save()
+}
+
+// active returns the hold of the service if it has not expired
+func (hs *HoldStore) active(serviceID string, now time.Time) *Hold {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if h, ok := hs.holds[serviceID]; ok && !h.expired(now) {
+		return h
+	}
+	return nil
+}
+
+// holdHandler handles GET and POST /services/{id}/hold and POST /services/{id}/release
+func (s *ServiceUpdater) holdHandler(w http.ResponseWriter, r *http.Request, id string, action string) {
+	switch {
+	case action == "hold" && r.Method == "GET":
+		h := s.holds.active(id, time.Now())
+		if h == nil {
+			utils.SendError(w, "Service is not held", 404)
+			return
+		}
+		sendJSON(w, h, 200)
+	case action == "hold" && r.Method == "POST":
+		var h Hold
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+				utils.SendError(w, err.Error(), 400)
+				return
+			}
+		}
+		svc, err := s.service.ById(id)
+		if err != nil || svc == nil || svc.Id == "" {
+			utils.SendError(w, "Service not found", 404)
+			return
+		}
+		h.ServiceID, h.Service, h.By, h.Created = svc.Id, svc.Name, caller(r), time.Now().UTC()
+		if h.Expires != nil && !h.Expires.After(h.Created) {
+			utils.SendError(w, "expires must be in the future", 400)
+			return
+		}
+		if err := s.holds.add(&h); err != nil {
+			utils.SendError(w, err.Error(), 500)
+			return
+		}
+		s.log.infof("Holding %s: %s", h.Service, h.reason())
+		s.audit.add(AuditHold, h.By, map[string]interface{}{"action": "held", "service": h.Service, "service_id": h.ServiceID, "reason": h.Reason, "expires": h.Expires})
+		sendJSON(w, h, 201)
+	case action == "release" && r.Method == "POST":
+		released, err := s.holds.remove(id)
+		if err != nil {
+			utils.SendError(w, err.Error(), 500)
+			return
+		}
+		if !released {
+			utils.SendError(w, "Service is not held", 404)
+			return
+		}
+		s.log.infof("Released hold of %s", id)
+		s.audit.add(AuditHold, caller(r), map[string]interface{}{"action": "released", "service_id": id})
+		w.WriteHeader(204)
+	default:
+		utils.SendError(w, "Not found", 404)
+	}
+}
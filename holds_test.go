@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_hold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	if updater.holds, err = openHolds(dir); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	w := httptest.NewRecorder()
+	updater.servicesHandler(w, httptest.NewRequest("POST", "/services/1s9/hold", nil))
+	if w.Code != 404 {
+		t.Errorf("expected unknown service to be rejected, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	updater.servicesHandler(w, httptest.NewRequest("POST", "/services/1s1/hold", strings.NewReader(`{"reason": "incident 42", "expires": "`+expires+`"}`)))
+	var hold Hold
+	if err := json.NewDecoder(w.Body).Decode(&hold); err != nil || w.Code != 201 || hold.Service != "api" || hold.Reason != "incident 42" {
+		t.Fatalf("unexpected response %d %+v %v", w.Code, hold, err)
+	}
+
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	if len(service.upgrades) != 0 {
+		t.Error("expected held service not to be upgraded")
+	}
+	if job.Status != JobSucceeded || len(job.Services) != 1 || job.Services[0].Status != ServiceHeld ||
+		!strings.HasPrefix(job.Services[0].Reason, "Held by 192.0.2.1 until "+expires+": incident 42") {
+		t.Errorf("expected the held service in the job, got %+v %+v", job, job.Services)
+	}
+	plan, _ := updater.plan(UpdateCommand{Image: "myorg/api:2.0"})
+	if len(plan) != 1 || plan[0].Decision != DecisionSkip || !strings.HasPrefix(plan[0].Reason, "Held by") {
+		t.Errorf("expected the plan to skip the held service, got %+v", plan)
+	}
+
+	reopened, err := openHolds(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := reopened.active("1s1", time.Now()); h == nil || h.Reason != "incident 42" {
+		t.Errorf("expected the hold to be loaded, got %+v", h)
+	}
+	if h := reopened.active("1s1", time.Now().Add(2*time.Hour)); h != nil {
+		t.Errorf("expected the hold to expire, got %+v", h)
+	}
+
+	w = httptest.NewRecorder()
+	updater.servicesHandler(w, httptest.NewRequest("POST", "/services/1s1/release", nil))
+	if w.Code != 204 {
+		t.Errorf("expected hold to be released, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	updater.servicesHandler(w, httptest.NewRequest("POST", "/services/1s1/release", nil))
+	if w.Code != 404 {
+		t.Errorf("expected released service not to be held, got %d", w.Code)
+	}
+	if reopened, _ := openHolds(dir); reopened.active("1s1", time.Now()) != nil {
+		t.Error("expected the release to be saved")
+	}
+	updater.upgradeService(updater.jobStore.create("myorg/api:2.0"), UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	if len(service.upgrades) != 1 {
+		t.Error("expected released service to be upgraded")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+const (
+	//HookPreUpgrade is called before a service upgrade is started
+	HookPreUpgrade = "pre_upgrade"
+	//HookPostUpgrade is called after a service upgrade has completed
+	HookPostUpgrade = "post_upgrade"
+	//HookPreFinish is called after verification and before an upgrade is finished
+	HookPreFinish = "pre_finish"
+	//HookOnFailure is called when a service upgrade fails or is aborted
+	HookOnFailure = "on_failure"
+
+	signatureHeader = "X-Autoupdate-Signature"
+	hookHeader      = "X-Autoupdate-Hook"
+)
+
+// HookEvent is the JSON body sent to upgrade hooks
+type HookEvent struct {
+	Hook        string `json:"hook"`
+	ServiceID   string `json:"service_id"`
+	Service     string `json:"service"`
+	StackID     string `json:"stack_id"`
+	Environment string `json:"environment"`
+	FromImage   string `json:"from_image"`
+	ToImage     string `json:"to_image"`
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	Error       string `json:"error,omitempty"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+var hookClient = &http.Client{Timeout: 30 * time.Second}
+
+// redactURL removes the credentials and the query of a URL, which may contain secrets
+func redactURL(raw string) string {
+	u, err := neturl.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.User, u.RawQuery = nil, ""
+	return u.String()
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the body using the hook secret
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *ServiceUpdater) callHook(url string, body []byte, hook string, traceparent string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(hookHeader, hook)
+	if traceparent != "" {
+		req.Header.Set(traceparentHeader, traceparent)
+	}
+	if s.Config.HookSecret != "" {
+		req.Header.Set(signatureHeader, sign(s.Config.HookSecret, body))
+	}
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+		if len(bytes.TrimSpace(message)) == 0 {
+			message = []byte(resp.Status)
+		}
+		return fmt.Errorf("%s", strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// runHooks calls every hook configured for the event. Failures of pre_* hooks
+// abort the upgrade and are returned, other hook failures are only logged.
+func (s *ServiceUpdater) runHooks(hook string, event HookEvent) error {
+	urls := s.Config.Hooks[hook]
+	if len(urls) == 0 {
+		return nil
+	}
+	event.Hook = hook
+	event.Timestamp = time.Now().Unix()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	abort := strings.HasPrefix(hook, "pre_")
+	for _, url := range urls {
+		span := s.span.child("hook "+hook, spanClient, "hook.name", hook, "hook.url", redactURL(url))
+		err := s.callHook(url, body, hook, span.traceparent())
+		span.finish(err)
+		if err != nil {
+			if abort {
+				return fmt.Errorf("%s hook aborted upgrade of %s: %s", hook, event.Service, err)
+			}
+			s.log.forEvent(event).warnf("%s hook for %s failed: %s", hook, event.Service, err)
+		}
+	}
+	return nil
+}
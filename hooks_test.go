@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_runHooks(t *testing.T) {
+	var received HookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(signatureHeader) != sign("secret", body) {
+			t.Errorf("invalid signature %s", r.Header.Get(signatureHeader))
+		}
+		json.Unmarshal(body, &received)
+		if r.URL.Path == "/busy" {
+			w.WriteHeader(409)
+			w.Write([]byte("queue not drained\n"))
+		}
+	}))
+	defer server.Close()
+
+	updater := &ServiceUpdater{Config: &Config{
+		HookSecret: "secret",
+		Hooks: map[string][]string{
+			HookPreUpgrade:  {server.URL + "/busy"},
+			HookPostUpgrade: {server.URL + "/busy"},
+			HookPreFinish:   {server.URL + "/ok"},
+		},
+	}}
+	event := HookEvent{Service: "worker", FromVersion: "1.0", ToVersion: "1.1"}
+
+	err := updater.runHooks(HookPreUpgrade, event)
+	if err == nil || !strings.HasSuffix(err.Error(), ": queue not drained") {
+		t.Fatalf("expected pre_upgrade hook to abort with its message, got %v", err)
+	}
+	if received.Hook != HookPreUpgrade || received.ToVersion != "1.1" {
+		t.Errorf("unexpected hook body %+v", received)
+	}
+	if err := updater.runHooks(HookPreFinish, event); err != nil {
+		t.Errorf("expected pre_finish hook to pass: %s", err)
+	}
+	if err := updater.runHooks(HookPostUpgrade, event); err != nil {
+		t.Errorf("expected post_upgrade failure not to abort: %s", err)
+	}
+	if err := updater.runHooks(HookOnFailure, event); err != nil {
+		t.Errorf("expected unconfigured hook to be skipped: %s", err)
+	}
+}
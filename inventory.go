@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+	"github.com/rancher/go-rancher/client"
+)
+
+// ManagedService is a service carrying the enable label in an enabled environment
+type ManagedService struct {
+	Service     client.Service
+	Environment string
+}
+
+// ServicePolicy is the effective upgrade policy of a managed service
+type ServicePolicy struct {
+	Strategy         string            `json:"strategy"`
+	OnFailure        string            `json:"on_failure,omitempty"`
+	Window           string            `json:"window,omitempty"`
+	RequiresApproval bool              `json:"requires_approval"`
+	Labels           map[string]string `json:"labels"`
+}
+
+// LastUpgrade is the most recent upgrade of a service recorded by the updater
+type LastUpgrade struct {
+	JobID     string    `json:"job_id"`
+	Status    string    `json:"status"`
+	FromImage string    `json:"from_image"`
+	ToImage   string    `json:"to_image"`
+	Updated   time.Time `json:"updated"`
+}
+
+// InventoryEntry describes a managed service in GET /services
+type InventoryEntry struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Environment string        `json:"environment"`
+	StackID     string        `json:"stack_id"`
+	Stack       string        `json:"stack,omitempty"`
+	Image       string        `json:"image"`
+	Tag         string        `json:"tag"`
+	Policy      ServicePolicy `json:"policy"`
+	State       string        `json:"state"`
+	HealthState string        `json:"health_state"`
+	LastUpgrade *LastUpgrade  `json:"last_upgrade,omitempty"`
+	Hold        *Hold         `json:"hold,omitempty"`
+}
+
+// manages reports whether the primary container or a sidekick of the service carries the enable label
+func (s *ServiceUpdater) manages(svc client.Service) bool {
+	if enabled(svc.LaunchConfig.Labels, s.Config.EnableLabel) {
+		return true
+	}
+	for _, config := range svc.SecondaryLaunchConfigs {
+		if _, _, labels := sidekick(config); enabled(labels, s.Config.EnableLabel) {
+			return true
+		}
+	}
+	return false
+}
+
+// managedServices lists the services the updater manages
+func (s *ServiceUpdater) managedServices() ([]ManagedService, error) {
+	envs, err := s.environmentNames()
+	if err != nil {
+		return nil, err
+	}
+	services, err := s.service.List(&client.ListOpts{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list rancher services: %s", err)
+	}
+	var managed []ManagedService
+	for services != nil {
+		for _, svc := range services.Data {
+			if svc.LaunchConfig == nil || !utils.EnvironmentEnabled(envs[svc.AccountId], s.Config.EnvironmentNames) {
+				continue
+			}
+			if s.manages(svc) {
+				managed = append(managed, ManagedService{Service: svc, Environment: envs[svc.AccountId]})
+			}
+		}
+		s.timed("service.next", func() error { services, err = services.Next(); return err })
+		if err != nil {
+			return nil, err
+		}
+	}
+	return managed, nil
+}
+
+// policy returns the policy labels of the service and the policies they resolve to
+func (s *ServiceUpdater) policy(m ManagedService) ServicePolicy {
+	policy := ServicePolicy{
+		Strategy:         strategyFor(UpdateCommand{}, m.Service),
+		OnFailure:        s.failurePolicy(m.Service),
+		RequiresApproval: utils.EnvironmentEnabled(m.Environment, s.Config.RequiresApproval),
+		Labels:           make(map[string]string),
+	}
+	for key := range m.Service.LaunchConfig.Labels {
+		if strings.HasPrefix(key, "autoupdate.") {
+			policy.Labels[key], _ = label(m.Service.LaunchConfig.Labels, key)
+		}
+	}
+	if window, err := s.windowFor(Candidate{Service: m.Service, Environment: m.Environment}); err != nil {
+		policy.Window = err.Error()
+	} else if window != nil {
+		policy.Window = window.Spec
+	}
+	return policy
+}
+
+// lastUpgrade returns the most recent upgrade of the service in the job store, or else in the history
+func (s *ServiceUpdater) lastUpgrade(serviceID string) *LastUpgrade {
+	for _, job := range s.jobStore.list() {
+		var last *LastUpgrade
+		job.mu.Lock()
+		for _, target := range job.Services {
+			if target.ServiceID == serviceID {
+				last = &LastUpgrade{JobID: job.ID, Status: target.Status, FromImage: target.FromImage, ToImage: target.ToImage, Updated: job.Updated}
+			}
+		}
+		job.mu.Unlock()
+		if last != nil {
+			return last
+		}
+	}
+	if records := s.history.list(HistoryFilter{Service: serviceID}); len(records) > 0 {
+		r := records[0]
+		return &LastUpgrade{JobID: r.JobID, Status: r.Outcome, FromImage: r.FromImage, ToImage: r.ToImage, Updated: r.Finished}
+	}
+	return nil
+}
+
+// inventory lists the managed services matching the image, environment and stack filters, empty filters matching everything.
+// An image filter without a tag matches every tag of the repository.
+func (s *ServiceUpdater) inventory(image string, env string, stack string) ([]InventoryEntry, error) {
+	managed, err := s.managedServices()
+	if err != nil {
+		return nil, err
+	}
+	image = strings.TrimPrefix(image, "docker:")
+	stacks := make(map[string]string)
+	entries := []InventoryEntry{}
+	for _, m := range managed {
+		current := strings.TrimPrefix(m.Service.LaunchConfig.ImageUuid, "docker:")
+		repo := repository(current)
+		if image != "" && image != current && image != repo {
+			continue
+		}
+		if env != "" && env != m.Environment {
+			continue
+		}
+		stackID := m.Service.EnvironmentId
+		name, ok := stacks[stackID]
+		if !ok && s.stack != nil && stackID != "" {
+			if found, err := s.stack.ById(stackID); err == nil && found != nil {
+				name = found.Name
+			}
+			stacks[stackID] = name
+		}
+		if stack != "" && stack != stackID && stack != name {
+			continue
+		}
+		entries = append(entries, InventoryEntry{
+			ID:          m.Service.Id,
+			Name:        m.Service.Name,
+			Environment: m.Environment,
+			StackID:     stackID,
+			Stack:       name,
+			Image:       repo,
+			Tag:         strings.TrimPrefix(strings.TrimPrefix(current, repo), ":"),
+			Policy:      s.policy(m),
+			State:       m.Service.State,
+			HealthState: m.Service.HealthState,
+			LastUpgrade: s.lastUpgrade(m.Service.Id),
+			Hold:        s.holds.active(m.Service.Id, time.Now()),
+		})
+	}
+	return entries, nil
+}
+
+// servicesHandler handles GET /services with the optional image, environment and stack query parameters,
+// and the holds of the services
+func (s *ServiceUpdater) servicesHandler(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/services"), "/"), "/")
+	if len(parts) == 2 {
+		s.holdHandler(w, r, parts[0], parts[1])
+		return
+	}
+	if parts[0] != "" {
+		utils.SendError(w, "Not found", 404)
+		return
+	}
+	if r.Method != "GET" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	query := r.URL.Query()
+	entries, err := s.inventory(query.Get("image"), query.Get("environment"), query.Get("stack"))
+	if err != nil {
+		utils.SendError(w, err.Error(), 500)
+		return
+	}
+	sendJSON(w, entries, 200)
+}
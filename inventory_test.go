@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func Test_inventory(t *testing.T) {
+	api := testService(map[string]interface{}{strategyLabel: StrategyCanary, windowLabel: "0 2 * * *|1h|UTC"})
+	api.EnvironmentId, api.State, api.HealthState = "1e1", "active", "healthy"
+	web := testService(map[string]interface{}{})
+	web.Id, web.Name, web.LaunchConfig.ImageUuid, web.EnvironmentId = "1s2", "web", "docker:myorg/web:1.0", "1e2"
+	unmanaged := client.Service{Resource: client.Resource{Id: "1s3"}, Name: "db", LaunchConfig: &client.LaunchConfig{ImageUuid: "docker:postgres:9"}}
+	updater, _ := newTestUpdater(api, web, unmanaged)
+	updater.stack = &mockStack{state: "active"}
+	updater.Config.RequiresApproval = []string{"dev"}
+	job := updater.jobStore.create("myorg/api:1.0")
+	job.add(&JobService{ServiceID: "1s1", FromImage: "docker:myorg/api:0.9", ToImage: "docker:myorg/api:1.0", Status: ServiceSucceeded})
+
+	w := httptest.NewRecorder()
+	updater.servicesHandler(w, httptest.NewRequest("GET", "/services", nil))
+	var entries []InventoryEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected response %d %v", w.Code, err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 managed services, got %+v", entries)
+	}
+	e := entries[0]
+	if e.Environment != "dev" || e.Stack != "shop" || e.Image != "myorg/api" || e.Tag != "1.0" || e.State != "active" || e.HealthState != "healthy" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Policy.Strategy != StrategyCanary || e.Policy.Window != "0 2 * * *|1h|UTC" || !e.Policy.RequiresApproval || e.Policy.Labels[strategyLabel] != StrategyCanary {
+		t.Errorf("unexpected policy %+v", e.Policy)
+	}
+	if e.LastUpgrade == nil || e.LastUpgrade.JobID != job.ID || e.LastUpgrade.ToImage != "docker:myorg/api:1.0" {
+		t.Errorf("unexpected last upgrade %+v", e.LastUpgrade)
+	}
+	if entries[1].LastUpgrade != nil || entries[1].Policy.Strategy != StrategyRolling {
+		t.Errorf("unexpected entry %+v", entries[1])
+	}
+
+	for query, expected := range map[string]int{
+		"image=myorg/web":     1,
+		"image=myorg/api:2.0": 0,
+		"environment=dev":     2,
+		"environment=prod":    0,
+		"stack=1e2":           1,
+		"stack=shop":          2,
+	} {
+		w := httptest.NewRecorder()
+		updater.servicesHandler(w, httptest.NewRequest("GET", "/services?"+query, nil))
+		var entries []InventoryEntry
+		if err := json.NewDecoder(w.Body).Decode(&entries); err != nil || len(entries) != expected {
+			t.Errorf("%s: expected %d services, got %d %v", query, expected, len(entries), err)
+		}
+	}
+}
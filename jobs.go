@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const queueFile = "queue.json"
+
+const (
+	//JobRunning is a job that is being worked on
+	JobRunning = "running"
+	//JobSucceeded is a job whose services were all upgraded
+	JobSucceeded = "succeeded"
+	//JobFailed is a job where at least one service upgrade failed
+	JobFailed = "failed"
+	//JobQueued is a job with services waiting for their maintenance window
+	JobQueued = "queued"
+	//JobAwaitingApproval is a job parked until it is approved
+	JobAwaitingApproval = "awaiting_approval"
+
+	//ServicePending is a service whose upgrade has not been started yet
+	ServicePending = "pending"
+	//ServiceQueued is a service waiting for its maintenance window
+	ServiceQueued = "queued"
+	//ServiceUpgrading is a service whose upgrade has been started
+	ServiceUpgrading = "upgrading"
+	//ServiceUpgraded is a service that was upgraded without confirmation
+	ServiceUpgraded = "upgraded"
+	//ServiceSucceeded is a service whose upgrade was finished
+	ServiceSucceeded = "succeeded"
+	//ServiceFailed is a service whose upgrade failed
+	ServiceFailed = "failed"
+	//ServiceAborted is a service whose upgrade was aborted before it started
+	ServiceAborted = "aborted"
+	//ServiceRolledBack is a service whose upgrade was rolled back
+	ServiceRolledBack = "rolled_back"
+	//ServiceHeld is a service that was not upgraded because it is held at its current version
+	ServiceHeld = "held"
+	//ServiceDropped is a service that was not upgraded because its trigger was received while paused
+	ServiceDropped = "dropped"
+	//ServiceSkipped is a queued service that no longer needed the upgrade once it could run, e.g.
+	//because it was upgraded to the version in the meantime
+	ServiceSkipped = "skipped"
+
+	maxJobs = 100
+)
+
+// Job tracks the upgrades started by one trigger
+type Job struct {
+	ID           string        `json:"id"`
+	Image        string        `json:"image,omitempty"`
+	Release      string        `json:"release,omitempty"`
+	Images       []string      `json:"images,omitempty"`
+	Environments []string      `json:"environments,omitempty"`
+	Promotion    string        `json:"promotion,omitempty"`
+	Trigger      string        `json:"trigger,omitempty"`
+	Caller       string        `json:"caller,omitempty"`
+	TraceID      string        `json:"trace_id,omitempty"`
+	Status       string        `json:"status"`
+	Approval     *Approval     `json:"approval,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Created      time.Time     `json:"created"`
+	Updated      time.Time     `json:"updated"`
+	Services     []*JobService `json:"services"`
+
+	// token is the API token that triggered the job, if any
+	token *APIToken
+	mu    sync.Mutex
+}
+
+// JobService is the upgrade of one service within a job
+type JobService struct {
+	ServiceID     string     `json:"service_id"`
+	Service       string     `json:"service"`
+	Environment   string     `json:"environment"`
+	StackID       string     `json:"stack_id,omitempty"`
+	FromImage     string     `json:"from_image"`
+	ToImage       string     `json:"to_image"`
+	LaunchConfigs []string   `json:"launch_configs"`
+	Strategy      string     `json:"strategy"`
+	Status        string     `json:"status"`
+	Stage         string     `json:"stage,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	Scheduled     *time.Time `json:"scheduled,omitempty"`
+	Started       *time.Time `json:"started,omitempty"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// queuedUpgrade is an upgrade waiting for the maintenance windows of its services
+type queuedUpgrade struct {
+	job        *Job
+	command    UpdateCommand
+	candidates []Candidate
+	targets    []*JobService
+	status     string
+	run        func()
+	running    bool
+}
+
+// QueuedJob is the trigger of a queued job, saved so that the job can be started again after a restart
+type QueuedJob struct {
+	JobID   string        `json:"job_id"`
+	Trigger string        `json:"trigger,omitempty"`
+	Caller  string        `json:"caller,omitempty"`
+	Command UpdateCommand `json:"command"`
+}
+
+// UpgradeQueue keeps the upgrades waiting for their maintenance window and saves their jobs to
+// queue.json in the data directory, if one is configured
+type UpgradeQueue struct {
+	mu    sync.Mutex
+	items []*queuedUpgrade
+	path  string
+	// restored are the jobs loaded from the queue file that have not been queued again yet
+	restored []QueuedJob
+	log      *Logger
+}
+
+// JobStore keeps the most recent jobs in memory
+type JobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func newJobStore() *JobStore {
+	return &JobStore{jobs: make(map[string]*Job)}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (js *JobStore) create(image string) *Job {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:       newID(),
+		Image:    image,
+		Status:   JobRunning,
+		Created:  now,
+		Updated:  now,
+		Services: []*JobService{},
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.jobs) >= maxJobs {
+		var oldest *Job
+		for _, j := range js.jobs {
+			if oldest == nil || j.Created.Before(oldest.Created) {
+				oldest = j
+			}
+		}
+		delete(js.jobs, oldest.ID)
+	}
+	js.jobs[job.ID] = job
+	return job
+}
+
+func (js *JobStore) get(id string) *Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.jobs[id]
+}
+
+func (js *JobStore) list() []*Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	jobs := make([]*Job, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Created.After(jobs[k].Created) })
+	return jobs
+}
+
+// openQueue loads the jobs saved in the data directory, to be started again with restoreQueue.
+// Without a data directory the queue is kept in memory only.
+func openQueue(dir string) (*UpgradeQueue, error) {
+	q := &UpgradeQueue{}
+	if dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q.path = filepath.Join(dir, queueFile)
+	content, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &q.restored); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", q.path, err)
+	}
+	return q, nil
+}
+
+// save writes the jobs of the queued upgrades to the queue file, replacing it atomically. It must
+// be called with the lock held.
+func (q *UpgradeQueue) save() {
+	if q.path == "" {
+		return
+	}
+	jobs := append([]QueuedJob{}, q.restored...)
+	seen := make(map[string]bool)
+	for _, item := range q.items {
+		if seen[item.job.ID] {
+			continue
+		}
+		seen[item.job.ID] = true
+		item.job.mu.Lock()
+		jobs = append(jobs, QueuedJob{JobID: item.job.ID, Trigger: item.job.Trigger, Caller: item.job.Caller, Command: item.command})
+		item.job.mu.Unlock()
+	}
+	content, err := json.MarshalIndent(jobs, "", "  ")
+	if err == nil {
+		tmp := q.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, content, 0600); err == nil {
+			err = os.Rename(tmp, q.path)
+		}
+	}
+	if err != nil {
+		q.log.errorf("Unable to save the queue to %s: %s", q.path, err)
+	}
+}
+
+// takeRestored returns the jobs loaded from the queue file. They are saved until forgotten.
+func (q *UpgradeQueue) takeRestored() []QueuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]QueuedJob{}, q.restored...)
+}
+
+// forget stops saving a restored job, once it was started again
+func (q *UpgradeQueue) forget(jobID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	restored := q.restored[:0]
+	for _, j := range q.restored {
+		if j.JobID != jobID {
+			restored = append(restored, j)
+		}
+	}
+	q.restored = restored
+	q.save()
+}
+
+func (q *UpgradeQueue) add(item *queuedUpgrade) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
+	q.save()
+}
+
+// ready marks the waiting upgrades accepted by the check as running and returns them. Upgrades
+// of the same service run one at a time in the order they were queued: an upgrade is not ready
+// while an earlier upgrade of one of its services is still queued or running.
+func (q *UpgradeQueue) ready(check func(*queuedUpgrade) bool) []*queuedUpgrade {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ready []*queuedUpgrade
+	busy := make(map[string]bool)
+	for _, item := range q.items {
+		free := !item.running
+		for _, c := range item.candidates {
+			if busy[c.Service.Id] {
+				free = false
+			}
+			busy[c.Service.Id] = true
+		}
+		if free && check(item) {
+			item.running = true
+			ready = append(ready, item)
+		}
+	}
+	return ready
+}
+
+// done removes the upgrade and returns how many upgrades of its job are still queued or running
+func (q *UpgradeQueue) done(item *queuedUpgrade) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	remaining := 0
+	items := q.items[:0]
+	for _, i := range q.items {
+		if i == item {
+			continue
+		}
+		items = append(items, i)
+		if i.job == item.job {
+			remaining++
+		}
+	}
+	q.items = items
+	q.save()
+	return remaining
+}
+
+func (q *UpgradeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// update applies a change to the job while holding its lock
+func (j *Job) update(f func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f()
+	j.Updated = time.Now().UTC()
+}
+
+func (j *Job) add(target *JobService) {
+	now := time.Now().UTC()
+	target.Started = &now
+	j.update(func() { j.Services = append(j.Services, target) })
+}
+
+// finish sets the final status of the job from the status of its services
+func (j *Job) finish() {
+	j.update(func() {
+		j.Status = JobSucceeded
+		if j.Error != "" {
+			j.Status = JobFailed
+		}
+		for _, target := range j.Services {
+			if target.Status == ServiceQueued {
+				j.Status = JobQueued
+				return
+			}
+		}
+		for _, target := range j.Services {
+			if target.Status == ServiceFailed || target.Status == ServiceAborted || target.Status == ServiceRolledBack {
+				j.Status = JobFailed
+			}
+		}
+	})
+}
+
+// complete records the upgrades of a job that is no longer queued and starts its promotions
+func (s *ServiceUpdater) complete(job *Job, command UpdateCommand) {
+	s.record(job)
+	s.promote(job, command)
+}
+
+// name returns the release of the job, or its image
+func (j *Job) name() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Release != "" {
+		return j.Release
+	}
+	return j.Image
+}
+
+func (j *Job) queued() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status == JobQueued
+}
+
+// MarshalJSON serializes the job while holding its lock
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	type job Job
+	return json.Marshal((*job)(j))
+}
+
+func sendJSON(w http.ResponseWriter, value interface{}, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func (s *ServiceUpdater) jobs(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/")
+	if r.Method == "POST" && len(parts) == 2 {
+		job := s.jobStore.get(parts[0])
+		if job == nil {
+			utils.SendError(w, "Job not found", 404)
+			return
+		}
+		s.approvalHandler(w, r, job, parts[1])
+		return
+	}
+	if r.Method != "GET" || len(parts) > 1 {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	if parts[0] == "" {
+		sendJSON(w, s.jobStore.list(), 200)
+		return
+	}
+	job := s.jobStore.get(parts[0])
+	if job == nil {
+		utils.SendError(w, "Job not found", 404)
+		return
+	}
+	sendJSON(w, job, 200)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//LogText writes log lines as a message followed by key=value fields
+	LogText = "text"
+	//LogJSON writes log lines as JSON objects
+	LogJSON = "json"
+
+	redacted = "[REDACTED]"
+)
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// logOutput is shared by a logger and the loggers derived from it with with
+type logOutput struct {
+	mu      sync.Mutex
+	w       io.Writer
+	level   int
+	format  string
+	secrets []string
+	redact  *strings.Replacer
+}
+
+// Logger writes leveled log lines with fields. Configured secrets are redacted from messages
+// and fields. A nil Logger discards everything.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// newLogger creates a logger writing lines of the level and above in the format
+func newLogger(w io.Writer, level string, format string) (*Logger, error) {
+	l, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("Unknown log level %s, expected debug, info, warn or error", level)
+	}
+	if format != LogText && format != LogJSON {
+		return nil, fmt.Errorf("Unknown log format %s, expected text or json", format)
+	}
+	return &Logger{out: &logOutput{w: w, level: l, format: format, redact: strings.NewReplacer()}}, nil
+}
+
+// redact replaces the secrets with [REDACTED] in every line written from now on
+func (l *Logger) redact(secrets ...string) {
+	if l == nil {
+		return
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	for _, secret := range secrets {
+		if secret != "" {
+			l.out.secrets = append(l.out.secrets, secret)
+		}
+	}
+	// Longer secrets first, so that a secret containing another one is redacted as a whole
+	sort.SliceStable(l.out.secrets, func(i, k int) bool { return len(l.out.secrets[i]) > len(l.out.secrets[k]) })
+	var pairs []string
+	for _, secret := range l.out.secrets {
+		pairs = append(pairs, secret, redacted)
+	}
+	l.out.redact = strings.NewReplacer(pairs...)
+}
+
+// redactString replaces the secrets in a text that is not written through the logger
+func (l *Logger) redactString(s string) string {
+	if l == nil {
+		return s
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	return l.out.redact.Replace(s)
+}
+
+// with returns a logger adding the key value pairs to every line
+func (l *Logger) with(pairs ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(pairs))
+	fields = append(fields, l.fields...)
+	return &Logger{out: l.out, fields: append(fields, pairs...)}
+}
+
+func (l *Logger) debugf(format string, args ...interface{}) { l.logf("debug", format, args...) }
+func (l *Logger) infof(format string, args ...interface{})  { l.logf("info", format, args...) }
+func (l *Logger) warnf(format string, args ...interface{})  { l.logf("warn", format, args...) }
+func (l *Logger) errorf(format string, args ...interface{}) { l.logf("error", format, args...) }
+
+// fatalf logs the error and exits
+func (l *Logger) fatalf(format string, args ...interface{}) {
+	l.logf("error", format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level string, format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	if logLevels[level] < l.out.level {
+		return
+	}
+	message := l.out.redact.Replace(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+	now := time.Now().UTC().Format(time.RFC3339)
+	if l.out.format == LogJSON {
+		line := []string{
+			fmt.Sprintf(`"time":%q`, now),
+			fmt.Sprintf(`"level":%q`, level),
+			fmt.Sprintf(`"msg":%s`, l.jsonValue(message)),
+		}
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			line = append(line, fmt.Sprintf("%s:%s", l.jsonValue(fmt.Sprint(l.fields[i])), l.jsonValue(l.fields[i+1])))
+		}
+		fmt.Fprintf(l.out.w, "{%s}\n", strings.Join(line, ","))
+		return
+	}
+	line := fmt.Sprintf("%s %-5s %s", now, strings.ToUpper(level), message)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		line += fmt.Sprintf(" %s=%s", l.fields[i], l.textValue(l.fields[i+1]))
+	}
+	fmt.Fprintln(l.out.w, line)
+}
+
+// jsonValue encodes a field value as JSON, redacting the secrets of strings
+func (l *Logger) jsonValue(value interface{}) string {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	if s, ok := value.(string); ok {
+		value = l.out.redact.Replace(s)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(l.out.redact.Replace(fmt.Sprint(value)))
+	}
+	return string(encoded)
+}
+
+// textValue formats a field value for text lines, quoting values with spaces
+func (l *Logger) textValue(value interface{}) string {
+	s := l.out.redact.Replace(fmt.Sprint(value))
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// forEvent returns a logger adding the fields of a service upgrade
+func (l *Logger) forEvent(event HookEvent) *Logger {
+	return l.with(
+		"service_id", event.ServiceID,
+		"service", event.Service,
+		"environment", event.Environment,
+		"image", strings.TrimPrefix(event.ToImage, "docker:"),
+		"from_version", event.FromVersion,
+		"to_version", event.ToVersion,
+	)
+}
+
+// jobLog returns the logger of the job
+func (s *ServiceUpdater) jobLog(job *Job) *Logger {
+	return s.log.with("job_id", job.ID)
+}
+
+// forTarget returns a logger adding the fields of a service of a job
+func (l *Logger) forTarget(target *JobService) *Logger {
+	return l.with(
+		"service_id", target.ServiceID,
+		"service", target.Service,
+		"environment", target.Environment,
+		"image", strings.TrimPrefix(target.ToImage, "docker:"),
+		"from_version", imageVersion(target.FromImage),
+		"to_version", imageVersion(target.ToImage),
+	)
+}
+
+// imageVersion returns the tag of an image, e.g. 1.0 for docker:myorg/api:1.0
+func imageVersion(image string) string {
+	image = strings.TrimPrefix(image, "docker:")
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		return image[idx+1:]
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_newLogger(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "verbose", LogText); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	var l *Logger
+	l.with("job_id", "1").infof("discarded")
+}
+
+func Test_loggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := newLogger(&buf, "info", LogText)
+	l.debugf("hidden")
+	l.with("service", "api", "reason", "two words").warnf("Upgrade of %s failed\n", "api")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line, got %q", buf.String())
+	}
+	if !strings.HasSuffix(lines[0], ` WARN  Upgrade of api failed service=api reason="two words"`) {
+		t.Errorf("unexpected line %s", lines[0])
+	}
+}
+
+func Test_loggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := newLogger(&buf, "debug", LogJSON)
+	l.with("job_id", "1", "error", fmt.Errorf("boom")).debugf("Checking %q", "api")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("invalid line %s: %s", buf.String(), err)
+	}
+	if line["level"] != "debug" || line["msg"] != `Checking "api"` || line["job_id"] != "1" || line["error"] != "boom" || line["time"] == nil {
+		t.Errorf("unexpected line %v", line)
+	}
+}
+
+func Test_loggerRedact(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := newLogger(&buf, "info", LogJSON)
+	l.redact("https://hooks.slack.com/services/T0/B0/secret", "secret", "")
+	l.with("url", "https://hooks.slack.com/services/T0/B0/secret").errorf("Unable to send with key %s", "secret")
+
+	if strings.Contains(buf.String(), "secret") || strings.Contains(buf.String(), "hooks.slack.com") {
+		t.Errorf("secret was not redacted: %s", buf.String())
+	}
+	if strings.Count(buf.String(), redacted) != 2 {
+		t.Errorf("unexpected redaction: %s", buf.String())
+	}
+}
+
+func Test_imageVersion(t *testing.T) {
+	for image, version := range map[string]string{
+		"docker:myorg/api:1.0":          "1.0",
+		"myorg/api":                     "",
+		"registry:5000/myorg/api":       "",
+		"docker:registry:5000/api:2.0b": "2.0b",
+	} {
+		if v := imageVersion(image); v != version {
+			t.Errorf("expected version %q of %s, got %q", version, image, v)
+		}
+	}
+}
+
+func Test_upgradeServiceLogs(t *testing.T) {
+	var buf bytes.Buffer
+	updater, _ := newTestUpdater(testService(map[string]interface{}{}))
+	updater.log, _ = newLogger(&buf, "info", LogJSON)
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	var found bool
+	for _, text := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			t.Fatalf("invalid line %s: %s", text, err)
+		}
+		if line["job_id"] != job.ID {
+			t.Errorf("line without job_id %s", text)
+		}
+		if line["msg"] == "Finished upgrade on api" {
+			found = true
+			if line["service_id"] != "1s1" || line["service"] != "api" || line["environment"] != "dev" ||
+				line["image"] != "myorg/api:2.0" || line["from_version"] != "1.0" || line["to_version"] != "2.0" {
+				t.Errorf("unexpected fields %s", text)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected a finished line in %s", buf.String())
+	}
+}
@@ -3,13 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/ahaynssen/slack-go-webhook"
+	"github.com/gorilla/websocket"
 	"github.com/objectpartners/rancher-service-updater/utils"
 	"github.com/rancher/go-rancher/client"
 )
@@ -17,38 +17,109 @@ import (
 type (
 	//Config is the service configuration
 	Config struct {
-		EnableLabel      string
-		EnvironmentNames []string
-		Port             int
-		CattleSecretKey  string
-		CattleAccessKey  string
-		CattleURL        string
-		SlackWebhookURL  string
-		SlackBotName     string
-		Debug            bool
+		EnableLabel        string
+		EnvironmentNames   []string
+		Port               int
+		CattleSecretKey    string
+		CattleAccessKey    string
+		CattleURL          string
+		SlackWebhookURL    string
+		SlackBotName       string
+		SlackBotToken      string
+		SlackChannel       string
+		SlackSigningSecret string
+		SlackUsers         map[string]string
+		FailurePolicy      string
+		Hooks              map[string][]string
+		HookSecret         string
+		BlueGreenTTL       time.Duration
+		Promotions         []PromotionRule
+		Windows            []*Window
+		RequiresApproval   []string
+		ApprovalTTL        time.Duration
+		APITokens          []APIToken
+		DataDir            string
+		AuditLog           string
+		PausePolicy        string
+		QueueLimit         int
+		StatsDAddress      string
+		StatsDPrefix       string
+		StatsDFlavor       string
+		LogLevel           string
+		LogFormat          string
+		TraceExporter      string
+		OTLPEndpoint       string
 	}
 
 	//ServiceUpdater is the service
 	ServiceUpdater struct {
 		Config *Config
 		// client  *client.RancherClient
-		service Service
-		account Account
+		service    Service
+		account    Account
+		container  Container
+		base       RancherBase
+		jobStore   *JobStore
+		blueGreen  *BlueGreenStore
+		promotions *PromotionStore
+		freezes    *FreezeStore
+		queue      *UpgradeQueue
+		history    *HistoryStore
+		audit      *AuditLog
+		holds      *HoldStore
+		pauses     *PauseStore
+		metrics    *Metrics
+		log        *Logger
+		tracer     *Tracer
+		readiness  *Readiness
+		span       *Span
+		stack      Stack
 	}
 
 	//UpdateCommand is payload for new image availability
 	UpdateCommand struct {
-		Image      string `json:"docker_image"`
-		StartFirst bool   `json:"start_first"`
-		Confirm    bool   `json:"confirm"`
-		Timeout    int    `json:"timeout"`
+		Image        string   `json:"docker_image"`
+		StartFirst   bool     `json:"start_first"`
+		Confirm      bool     `json:"confirm"`
+		Timeout      int      `json:"timeout"`
+		BatchSize    int64    `json:"batch_size"`
+		Interval     int64    `json:"interval"`
+		Strategy     string   `json:"strategy"`
+		CanaryBake   int      `json:"canary_bake"`
+		Images       []string `json:"docker_images"`
+		Release      string   `json:"release"`
+		Environments []string `json:"environments"`
+	}
+
+	//Candidate is a service matched by an upgrade command
+	Candidate struct {
+		Service     client.Service
+		Environment string
+		FromImage   string
+		FromVersion string
+		ToVersion   string
+		Primary     bool
+		Sidekicks   []string
+	}
+
+	//Match is a managed service compared with an upgrade command, with the reason it is not upgraded
+	Match struct {
+		Candidate
+		Reason string
+		Held   bool
 	}
 
 	//Service is Rancher Service interface
 	Service interface {
 		ById(id string) (*client.Service, error)
 		List(opts *client.ListOpts) (*client.ServiceCollection, error)
+		Create(opts *client.Service) (*client.Service, error)
+		ActionActivate(*client.Service) (*client.Service, error)
+		ActionDeactivate(*client.Service) (*client.Service, error)
+		ActionRemove(*client.Service) (*client.Service, error)
+		ActionCancelupgrade(*client.Service) (*client.Service, error)
 		ActionFinishupgrade(*client.Service) (*client.Service, error)
+		ActionRollback(*client.Service) (*client.Service, error)
 		ActionUpgrade(*client.Service, *client.ServiceUpgrade) (*client.Service, error)
 	}
 
@@ -56,24 +127,176 @@ type (
 	Account interface {
 		List(opts *client.ListOpts) (*client.AccountCollection, error)
 	}
+
+	//Stack is Rancher Stack interface, called environment in the Rancher v1 API
+	Stack interface {
+		ById(id string) (*client.Environment, error)
+		ActionExportconfig(*client.Environment, *client.ComposeConfigInput) (*client.ComposeConfig, error)
+		ActionFinishupgrade(*client.Environment) (*client.Environment, error)
+		ActionRollback(*client.Environment) (*client.Environment, error)
+		ActionUpgrade(*client.Environment, *client.EnvironmentUpgrade) (*client.Environment, error)
+	}
+
+	//Container is Rancher Container interface
+	Container interface {
+		ActionExecute(*client.Container, *client.ContainerExec) (*client.HostAccess, error)
+	}
+
+	//RancherBase is the Rancher client interface for following links and opening websockets
+	RancherBase interface {
+		GetLink(resource client.Resource, link string, respObject interface{}) error
+		Websocket(url string, headers map[string][]string) (*websocket.Conn, *http.Response, error)
+	}
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		path := auditLogPath()
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		os.Exit(runVerify(path))
+	}
 	config := &Config{
-		EnableLabel:      utils.GetEnvOrDefault("AUTOUPDATE_ENABLE_LABEL", "autoupdate.enable"),
-		EnvironmentNames: utils.GetEnvOrDefaultArray("AUTOUPDATE_ENVIRONMENT_NAMES", []string{".*"}),
-		Port:             utils.GetEnvOrDefaultInt("AUTOUPDATE_HTTP_PORT", 8080),
-		CattleAccessKey:  os.Getenv("CATTLE_ACCESS_KEY"),
-		CattleSecretKey:  os.Getenv("CATTLE_SECRET_KEY"),
-		CattleURL:        os.Getenv("CATTLE_URL"),
-		SlackWebhookURL:  os.Getenv("AUTOUPDATE_SLACK_WEBHOOK_URL"),
-		SlackBotName:     utils.GetEnvOrDefault("AUTOUPDATE_SLACK_BOT_NAME", "rancher-service-updater"),
-		Debug:            os.Getenv("DEBUG") != "",
+		EnableLabel:        utils.GetEnvOrDefault("AUTOUPDATE_ENABLE_LABEL", "autoupdate.enable"),
+		EnvironmentNames:   utils.GetEnvOrDefaultArray("AUTOUPDATE_ENVIRONMENT_NAMES", []string{".*"}),
+		Port:               utils.GetEnvOrDefaultInt("AUTOUPDATE_HTTP_PORT", 8080),
+		CattleAccessKey:    os.Getenv("CATTLE_ACCESS_KEY"),
+		CattleSecretKey:    os.Getenv("CATTLE_SECRET_KEY"),
+		CattleURL:          os.Getenv("CATTLE_URL"),
+		SlackWebhookURL:    os.Getenv("AUTOUPDATE_SLACK_WEBHOOK_URL"),
+		SlackBotName:       utils.GetEnvOrDefault("AUTOUPDATE_SLACK_BOT_NAME", "rancher-service-updater"),
+		SlackBotToken:      os.Getenv("AUTOUPDATE_SLACK_BOT_TOKEN"),
+		SlackChannel:       os.Getenv("AUTOUPDATE_SLACK_CHANNEL"),
+		SlackSigningSecret: os.Getenv("AUTOUPDATE_SLACK_SIGNING_SECRET"),
+		FailurePolicy:      utils.GetEnvOrDefault("AUTOUPDATE_FAILURE_POLICY", FailurePolicyNone),
+		Hooks: map[string][]string{
+			HookPreUpgrade:  utils.GetEnvOrDefaultArray("AUTOUPDATE_HOOK_PRE_UPGRADE", nil),
+			HookPostUpgrade: utils.GetEnvOrDefaultArray("AUTOUPDATE_HOOK_POST_UPGRADE", nil),
+			HookPreFinish:   utils.GetEnvOrDefaultArray("AUTOUPDATE_HOOK_PRE_FINISH", nil),
+			HookOnFailure:   utils.GetEnvOrDefaultArray("AUTOUPDATE_HOOK_ON_FAILURE", nil),
+		},
+		HookSecret:       os.Getenv("AUTOUPDATE_HOOK_SECRET"),
+		BlueGreenTTL:     time.Duration(utils.GetEnvOrDefaultInt("AUTOUPDATE_BLUEGREEN_TTL", 86400)) * time.Second,
+		RequiresApproval: utils.GetEnvOrDefaultArray("AUTOUPDATE_REQUIRES_APPROVAL", nil),
+		ApprovalTTL:      time.Duration(utils.GetEnvOrDefaultInt("AUTOUPDATE_APPROVAL_TTL", 14400)) * time.Second,
+		DataDir:          os.Getenv("AUTOUPDATE_DATA_DIR"),
+		AuditLog:         auditLogPath(),
+		PausePolicy:      utils.GetEnvOrDefault("AUTOUPDATE_PAUSE_POLICY", PauseQueue),
+		QueueLimit:       utils.GetEnvOrDefaultInt("AUTOUPDATE_QUEUE_LIMIT", 100),
+		StatsDAddress:    os.Getenv("AUTOUPDATE_STATSD_ADDRESS"),
+		StatsDPrefix:     utils.GetEnvOrDefault("AUTOUPDATE_STATSD_PREFIX", "rancher_updater"),
+		StatsDFlavor:     utils.GetEnvOrDefault("AUTOUPDATE_STATSD_FLAVOR", DogStatsDFlavor),
+		LogLevel:         utils.GetEnvOrDefault("AUTOUPDATE_LOG_LEVEL", "info"),
+		LogFormat:        utils.GetEnvOrDefault("AUTOUPDATE_LOG_FORMAT", LogText),
+		TraceExporter:    os.Getenv("AUTOUPDATE_TRACE_EXPORTER"),
+		OTLPEndpoint:     utils.GetEnvOrDefault("AUTOUPDATE_OTLP_ENDPOINT", "http://localhost:4318/v1/traces"),
+	}
+	if os.Getenv("DEBUG") != "" {
+		config.LogLevel = "debug"
+	}
+	logger, err := newLogger(os.Stdout, config.LogLevel, config.LogFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logger.redact(config.CattleAccessKey, config.CattleSecretKey, config.SlackWebhookURL, config.SlackBotToken,
+		config.SlackSigningSecret, config.HookSecret)
+	promotions, err := parsePromotions(utils.GetEnvOrDefaultArray("AUTOUPDATE_PROMOTIONS", nil))
+	if err != nil {
+		logger.fatalf("Unable to parse AUTOUPDATE_PROMOTIONS: %s", err)
+	}
+	config.Promotions = promotions
+	windows, err := parseWindows(os.Getenv("AUTOUPDATE_WINDOWS"))
+	if err != nil {
+		logger.fatalf("Unable to parse AUTOUPDATE_WINDOWS: %s", err)
+	}
+	config.Windows = windows
+	tokens, err := parseTokens(utils.GetEnvOrDefaultArray("AUTOUPDATE_API_TOKENS", nil))
+	if err != nil {
+		logger.fatalf("Unable to parse AUTOUPDATE_API_TOKENS: %s", err)
+	}
+	config.APITokens = tokens
+	for _, token := range tokens {
+		logger.redact(token.Token)
+	}
+	slackUsers, err := parseSlackUsers(utils.GetEnvOrDefaultArray("AUTOUPDATE_SLACK_USERS", nil))
+	if err != nil {
+		logger.fatalf("Unable to parse AUTOUPDATE_SLACK_USERS: %s", err)
+	}
+	config.SlackUsers = slackUsers
+	history, err := openHistory(config.DataDir)
+	if err != nil {
+		logger.fatalf("Unable to open history: %s", err)
+	}
+	history.log = logger
+	if config.PausePolicy != PauseQueue && config.PausePolicy != PauseDrop {
+		logger.fatalf("Unknown AUTOUPDATE_PAUSE_POLICY %s, expected queue or drop", config.PausePolicy)
+	}
+	pauses, err := openPauses(config.DataDir)
+	if err != nil {
+		logger.fatalf("Unable to load pauses: %s", err)
+	}
+	metrics := newMetrics()
+	if config.StatsDAddress != "" {
+		if metrics.statsd, err = newStatsD(config.StatsDAddress, config.StatsDPrefix, config.StatsDFlavor); err != nil {
+			logger.fatalf("Unable to configure StatsD: %s", err)
+		}
+	}
+	holds, err := openHolds(config.DataDir)
+	if err != nil {
+		logger.fatalf("Unable to load holds: %s", err)
+	}
+	blueGreen, err := openBlueGreen(config.DataDir)
+	if err != nil {
+		logger.fatalf("Unable to load blue/green services: %s", err)
+	}
+	freezes, err := openFreezes(config.DataDir)
+	if err != nil {
+		logger.fatalf("Unable to load freezes: %s", err)
+	}
+	promotionStore, err := openPromotions(config.DataDir)
+	if err != nil {
+		logger.fatalf("Unable to load promotions: %s", err)
+	}
+	queue, err := openQueue(config.DataDir)
+	if err != nil {
+		logger.fatalf("Unable to load the queue: %s", err)
+	}
+	queue.log = logger
+	tracer, err := newTracing(config.TraceExporter, config.OTLPEndpoint, logger)
+	if err != nil {
+		logger.fatalf("Unable to configure tracing: %s", err)
+	}
+	var audit *AuditLog
+	if config.AuditLog != "" {
+		if audit, err = openAuditLog(config.AuditLog); err != nil {
+			logger.fatalf("Unable to open audit log: %s", err)
+		}
+		audit.log = logger
 	}
 	serviceUpdater := &ServiceUpdater{
-		Config: config,
+		Config:     config,
+		jobStore:   newJobStore(),
+		blueGreen:  blueGreen,
+		promotions: promotionStore,
+		freezes:    freezes,
+		queue:      queue,
+		history:    history,
+		audit:      audit,
+		holds:      holds,
+		pauses:     pauses,
+		metrics:    metrics,
+		log:        logger,
+		tracer:     tracer,
+		readiness:  &Readiness{},
 	}
 	serviceUpdater.init()
+	serviceUpdater.auditConfig()
+	serviceUpdater.restoreQueue()
+	serviceUpdater.resumePromotions()
+	go serviceUpdater.sweepBlueGreen()
+	go serviceUpdater.runQueue()
 	serviceUpdater.listen()
 }
 
@@ -84,19 +307,46 @@ func (s *ServiceUpdater) init() {
 		Url:       s.Config.CattleURL,
 	})
 	if err != nil {
-		log.Fatalf("Unable to create Rancher client: %s\n", err)
+		s.log.fatalf("Unable to create Rancher client: %s", err)
 	}
-	s.service = c.Service
-	s.account = c.Account
+	s.service = instrumentedService{c.Service, instrumentation{metrics: s.metrics}}
+	s.account = instrumentedAccount{c.Account, instrumentation{metrics: s.metrics}}
+	s.container = instrumentedContainer{c.Container, instrumentation{metrics: s.metrics}}
+	s.stack = instrumentedStack{c.Environment, instrumentation{metrics: s.metrics}}
+	s.base = instrumentedBase{c, instrumentation{metrics: s.metrics}}
 }
 
 func (s *ServiceUpdater) listen() {
-	http.HandleFunc("/upgrade", s.upgrade)
-	http.HandleFunc("/ping", s.ping)
-	log.Printf("Started service on port %d\n", s.Config.Port)
+	handle := func(pattern string, handler http.HandlerFunc) {
+		http.HandleFunc(pattern, s.trace(handler))
+	}
+	handle("/upgrade", s.authorize(ScopeUpgrade, ScopeUpgrade, s.upgrade))
+	handle("/plan", s.authorize(ScopeRead, ScopeRead, s.planHandler))
+	handle("/ping", s.ping)
+	handle("/healthz", s.healthzHandler)
+	handle("/readyz", s.readyzHandler)
+	handle("/status", s.authorize(ScopeRead, ScopeRead, s.statusHandler))
+	handle("/metrics", s.authorize(ScopeRead, ScopeRead, s.metricsHandler))
+	handle("/pause", s.authorize(ScopeAdmin, ScopeAdmin, s.pauseHandler))
+	handle("/resume", s.authorize(ScopeAdmin, ScopeAdmin, s.pauseHandler))
+	handle("/services", s.authorize(ScopeRead, ScopeAdmin, s.servicesHandler))
+	handle("/services/", s.authorize(ScopeRead, ScopeAdmin, s.servicesHandler))
+	handle("/history", s.authorize(ScopeRead, ScopeRead, s.historyHandler))
+	handle("/history/", s.authorize(ScopeRead, ScopeRead, s.historyHandler))
+	handle("/jobs", s.authorize(ScopeRead, ScopeApprove, s.jobs))
+	handle("/jobs/", s.authorize(ScopeRead, ScopeApprove, s.jobs))
+	handle("/bluegreen", s.authorize(ScopeRead, ScopeAdmin, s.blueGreenHandler))
+	handle("/bluegreen/", s.authorize(ScopeRead, ScopeAdmin, s.blueGreenHandler))
+	handle("/promotions", s.authorize(ScopeRead, ScopeApprove, s.promotionsHandler))
+	handle("/promotions/", s.authorize(ScopeRead, ScopeApprove, s.promotionsHandler))
+	handle("/freezes", s.authorize(ScopeRead, ScopeAdmin, s.freezesHandler))
+	handle("/freezes/", s.authorize(ScopeRead, ScopeAdmin, s.freezesHandler))
+	handle("/slack/actions", s.slackActions)
+	handle("/slack/commands", s.slashCommand)
+	s.log.infof("Started service on port %d", s.Config.Port)
 	err := http.ListenAndServe(fmt.Sprintf(":%d", s.Config.Port), nil)
 	if err != nil {
-		log.Fatalf("Unable to start service on port %d\n", s.Config.Port)
+		s.log.fatalf("Unable to start service on port %d: %s", s.Config.Port, err)
 	}
 }
 
@@ -105,7 +355,8 @@ func (s *ServiceUpdater) ping(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (s *ServiceUpdater) upgrade(w http.ResponseWriter, r *http.Request) {
+// decodeCommand reads the upgrade command of an /upgrade or /plan request
+func (s *ServiceUpdater) decodeCommand(r *http.Request) (UpdateCommand, error) {
 	command := UpdateCommand{
 		StartFirst: false,
 		Timeout:    30,
@@ -113,143 +364,518 @@ func (s *ServiceUpdater) upgrade(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&command)
 	if err != nil {
-		log.Printf("%s\n", err.Error())
+		s.log.warnf("Invalid upgrade command: %s", err)
+		return command, err
+	}
+	txt, _ := json.Marshal(command)
+	s.log.debugf("Received upgrade: %s", string(txt))
+	if command.Image != "" && len(command.Images) > 0 {
+		command.Images = append([]string{command.Image}, command.Images...)
+	}
+	if command.Image == "" && len(command.Images) == 0 {
+		return command, fmt.Errorf("docker_image or docker_images is required")
+	}
+	return command, nil
+}
+
+func (s *ServiceUpdater) upgrade(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	command, err := s.decodeCommand(r)
+	if err != nil {
+		s.metrics.triggerReceived(TriggerAPI, "rejected")
 		utils.SendError(w, err.Error(), 400)
 		return
 	}
-	txt, _ := json.Marshal(command)
-	if s.Config.Debug {
-		fmt.Printf("Received upgrade: %s", string(txt))
+	s.metrics.triggerReceived(TriggerAPI, "accepted")
+	job := s.jobStore.create(command.Image)
+	job.update(func() {
+		job.Environments = command.Environments
+		job.Trigger = TriggerAPI
+		job.Caller = caller(r)
+		job.token = requestToken(r)
+	})
+	if len(command.Images) > 0 {
+		if command.Release == "" {
+			command.Release = job.ID
+		}
+		job.update(func() {
+			job.Release = command.Release
+			job.Images = command.Images
+		})
 	}
-	go s.upgradeService(command)
-	w.WriteHeader(200)
+	s.auditJob(job)
+	go s.runJob(job, command)
+	sendJSON(w, map[string]string{"job_id": job.ID}, 200)
 	return
 }
 
-func (s *ServiceUpdater) upgradeService(command UpdateCommand) {
+func (s *ServiceUpdater) upgradeService(job *Job, command UpdateCommand) {
+	defer job.finish()
+	log := s.jobLog(job).with("image", strings.TrimPrefix(command.Image, "docker:"))
 	if !strings.HasPrefix(command.Image, "docker:") {
 		command.Image = fmt.Sprintf("docker:%s", command.Image)
 	}
-	idx := strings.LastIndex(command.Image, ":")
-	wantedImage := command.Image[0 : idx-1]
-	wantedVer := command.Image[idx:]
 
-	services, err := s.service.List(&client.ListOpts{})
+	candidates, err := s.findCandidates(job, command)
 	if err != nil {
-		fmt.Printf("Failed to list rancher services: %s\n", err)
+		log.errorf("Unable to find services to upgrade: %s", err)
+		job.update(func() { job.Error = err.Error() })
+		return
+	}
+	log.infof("Found %d service(s) to upgrade", len(candidates))
+	if err := s.requireApproval(job, candidates); err != nil {
+		job.update(func() { job.Error = err.Error() })
 		return
 	}
+	job.mu.Lock()
+	approved := job.Approval != nil
+	job.mu.Unlock()
+	if approved {
+		candidates = s.recheckApproved(job, command, candidates)
+	}
+
+	stacks := make(map[string][]Candidate)
+	var stackIDs []string
+	for _, c := range candidates {
+		if strategyFor(command, c.Service) == StrategyStack {
+			if _, ok := stacks[c.Service.EnvironmentId]; !ok {
+				stackIDs = append(stackIDs, c.Service.EnvironmentId)
+			}
+			stacks[c.Service.EnvironmentId] = append(stacks[c.Service.EnvironmentId], c)
+			continue
+		}
+		s.upgradeOne(job, command, c)
+	}
+	for _, id := range stackIDs {
+		s.upgradeStack(job, command, id, stacks[id])
+	}
+}
+
+// findCandidates lists the services in enabled environments whose image is older than the command image.
+// Held services that would have been upgraded are added to the job with the reason. It fails if the
+// token that triggered the job may not upgrade one of the environments.
+func (s *ServiceUpdater) findCandidates(job *Job, command UpdateCommand) ([]Candidate, error) {
+	matches, err := s.matchServices(command)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Candidate
+	for _, m := range matches {
+		if m.Held {
+			event := m.event(command)
+			job.add(&JobService{
+				ServiceID:     m.Service.Id,
+				Service:       m.Service.Name,
+				Environment:   m.Environment,
+				StackID:       m.Service.EnvironmentId,
+				FromImage:     event.FromImage,
+				ToImage:       event.ToImage,
+				LaunchConfigs: m.launchConfigs(),
+				Strategy:      strategyFor(command, m.Service),
+				Status:        ServiceHeld,
+				Reason:        m.Reason,
+			})
+			s.jobLog(job).forEvent(event).infof("Skipping held service %s: %s", m.Service.Name, m.Reason)
+		} else if m.Reason == "" {
+			candidates = append(candidates, m.Candidate)
+		}
+	}
+	job.mu.Lock()
+	token := job.token
+	job.mu.Unlock()
+	for _, c := range candidates {
+		if err := token.mayUse(ScopeUpgrade, c.Environment); err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// recheckApproved refreshes the candidates once the approval came in, as the job may have waited
+// for it for hours. Services that would no longer be upgraded are added to the job with the reason.
+func (s *ServiceUpdater) recheckApproved(job *Job, command UpdateCommand, candidates []Candidate) []Candidate {
+	var current []Candidate
+	for _, c := range candidates {
+		m, err := s.refresh(command, c)
+		if err == nil && m.Reason == "" {
+			current = append(current, m.Candidate)
+			continue
+		}
+		event := c.event(command)
+		target := &JobService{
+			ServiceID:     c.Service.Id,
+			Service:       c.Service.Name,
+			Environment:   c.Environment,
+			StackID:       c.Service.EnvironmentId,
+			FromImage:     event.FromImage,
+			ToImage:       event.ToImage,
+			LaunchConfigs: c.launchConfigs(),
+			Strategy:      strategyFor(command, c.Service),
+		}
+		if err != nil {
+			s.jobLog(job).forEvent(event).errorf("Unable to check service %s again: %s", c.Service.Name, err)
+			target.Status, target.Error = ServiceFailed, err.Error()
+		} else {
+			s.jobLog(job).forEvent(event).infof("Not upgrading %s any more: %s", c.Service.Name, m.Reason)
+			target.Status, target.Reason = ServiceSkipped, m.Reason
+			if m.Held {
+				target.Status = ServiceHeld
+			}
+		}
+		job.add(target)
+	}
+	return current
+}
+
+// matchServices compares every managed service with the command image. Services that would
+// not be upgraded carry the reason.
+func (s *ServiceUpdater) matchServices(command UpdateCommand) ([]Match, error) {
+	services, err := s.service.List(&client.ListOpts{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list rancher services: %s", err)
+	}
+
+	envs, err := s.environmentNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Match
+	for services != nil {
+		for _, svc := range services.Data {
+			if match, ok := s.match(command, svc, envs[svc.AccountId]); ok {
+				matches = append(matches, match)
+			}
+		}
+		s.timed("service.next", func() (e error) { services, e = services.Next(); return })
+	}
+	return matches, nil
+}
+
+// match compares the service in the environment with the command image, reporting false if the
+// service is not managed. A service that would not be upgraded carries the reason.
+func (s *ServiceUpdater) match(command UpdateCommand, svc client.Service, env string) (Match, bool) {
+	wantedImage, wantedVer := splitImage(command.Image)
+	enabledLabel := s.Config.EnableLabel
+	s.log.debugf("Checking service: %s", svc.Name)
+	if svc.LaunchConfig == nil || !s.manages(svc) {
+		return Match{}, false
+	}
+	match := Match{Candidate: Candidate{
+		Service:     svc,
+		Environment: env,
+		FromImage:   svc.LaunchConfig.ImageUuid,
+		ToVersion:   strings.TrimPrefix(wantedVer, ":"),
+	}}
+	skip := func(reason string) (Match, bool) {
+		s.log.debugf("Skipping service %s: %s", svc.Name, reason)
+		match.Reason = reason
+		return match, true
+	}
+	if entry := s.blueGreen.get(svc.Id); entry != nil {
+		return skip(fmt.Sprintf("Kept for rollback of %s", entry.Green))
+	}
+	if !utils.EnvironmentEnabled(env, s.Config.EnvironmentNames) {
+		return skip(fmt.Sprintf("Updating not enabled for environment %s", env))
+	}
+	if !s.environmentAllowed(command, env) {
+		return skip(fmt.Sprintf("Environment %s is not upgraded by this trigger", env))
+	}
+	primary := enabled(svc.LaunchConfig.Labels, enabledLabel)
+	sidekicks, sidekickImage := matchSidekicks(svc, enabledLabel, wantedImage, wantedVer)
+	foundImage, foundVer := splitImage(svc.LaunchConfig.ImageUuid)
+	s.log.debugf("Service %s Comparision: found-image %s, found-version %s, wanted-image %s, wanted-version %s", svc.Name, foundImage, foundVer, wantedImage, wantedVer)
+	match.Sidekicks = sidekicks
+	if primary && foundImage == wantedImage && newer(foundVer, wantedVer) {
+		match.Primary = true
+	} else if len(sidekicks) > 0 {
+		match.FromImage = sidekickImage
+	} else if primary && foundImage == wantedImage {
+		return skip(fmt.Sprintf("Published version %s is not newer than current version %s",
+			strings.TrimPrefix(wantedVer, ":"), strings.TrimPrefix(foundVer, ":")))
+	} else {
+		return skip("Image does not match")
+	}
+	_, fromVer := splitImage(match.FromImage)
+	match.FromVersion = strings.TrimPrefix(fromVer, ":")
+	if hold := s.holds.active(svc.Id, time.Now()); hold != nil {
+		match.Held = true
+		return skip(hold.reason())
+	}
+	return match, true
+}
+
+// serviceByID loads the service with the id, failing if it no longer exists
+func (s *ServiceUpdater) serviceByID(id string) (*client.Service, error) {
+	svc, err := s.service.ById(id)
+	if err != nil {
+		return nil, err
+	}
+	if svc == nil {
+		return nil, fmt.Errorf("Service %s not found", id)
+	}
+	return svc, nil
+}
+
+// refresh matches a candidate again with the current state of its service, which may have been
+// changed or upgraded while the upgrade waited, so that the upgrade starts from the current
+// launch config. A service that would no longer be upgraded carries the reason.
+func (s *ServiceUpdater) refresh(command UpdateCommand, c Candidate) (Match, error) {
+	svc, err := s.service.ById(c.Service.Id)
+	if err != nil {
+		return Match{}, err
+	}
+	if svc == nil {
+		return Match{}, fmt.Errorf("Service %s no longer exists", c.Service.Name)
+	}
+	m, ok := s.match(command, *svc, c.Environment)
+	if !ok {
+		m.Candidate = c
+		m.Reason = fmt.Sprintf("Service %s is no longer managed", svc.Name)
+	}
+	return m, nil
+}
+
+// recheck refreshes the candidate of a queued upgrade. A service that would no longer be
+// upgraded is marked on its target with the reason.
+func (s *ServiceUpdater) recheck(job *Job, target *JobService, command UpdateCommand, c Candidate) (Candidate, bool) {
+	m, err := s.refresh(command, c)
+	if err != nil {
+		s.jobLog(job).forTarget(target).errorf("Unable to check service %s again: %s", c.Service.Name, err)
+		job.update(func() {
+			target.Status = ServiceFailed
+			target.Error = err.Error()
+		})
+		return c, false
+	}
+	svc := m.Service
+	if m.Reason != "" {
+		s.jobLog(job).forTarget(target).infof("Not upgrading %s any more: %s", svc.Name, m.Reason)
+		job.update(func() {
+			target.Status = ServiceSkipped
+			if m.Held {
+				target.Status = ServiceHeld
+			}
+			target.Reason = m.Reason
+		})
+		return c, false
+	}
+	return m.Candidate, true
+}
 
+// environmentNames returns the names of the Rancher environments by id
+func (s *ServiceUpdater) environmentNames() (map[string]string, error) {
 	environments, err := s.account.List(&client.ListOpts{})
 	if err != nil {
-		fmt.Printf("Failed to get environments: %s\n", err)
-		return
+		return nil, fmt.Errorf("Failed to get environments: %s", err)
 	}
 	envs := make(map[string]string)
 	for environments != nil {
 		for _, env := range environments.Data {
 			envs[env.Id] = env.Name
 		}
-		environments, err = environments.Next()
+		s.timed("account.next", func() error { environments, err = environments.Next(); return err })
 		if err != nil {
-			fmt.Printf("Failed: %s\n", err)
-			return
+			return nil, err
 		}
 	}
+	return envs, nil
+}
 
-	var enabledLabel = s.Config.EnableLabel
-	for services != nil {
-		for _, svc := range services.Data {
-			if s.Config.Debug {
-				log.Printf("Checking service: %s", svc.Name)
-			}
-			if svc.LaunchConfig != nil {
-				if enable, ok := svc.LaunchConfig.Labels[enabledLabel]; ok && enable != "false" {
-					if s.Config.Debug {
-						log.Printf("Attempting to update service %s\n", svc.Name)
-					}
-					idx := strings.LastIndex(svc.LaunchConfig.ImageUuid, ":")
-
-					foundImage := svc.LaunchConfig.ImageUuid[0 : idx-1]
-					foundVer := svc.LaunchConfig.ImageUuid[idx:]
-					if utils.EnvironmentEnabled(envs[svc.AccountId], s.Config.EnvironmentNames) {
-						if s.Config.Debug {
-							log.Printf("Service %s Comparision: found-image %s, found-version %s, wanted-image %s, wanted-version %s\n", svc.Name, foundImage, foundVer, wantedImage, wantedVer)
-						}
-						if foundImage == wantedImage && ((foundVer < wantedVer) || (wantedVer == "latest")) {
-							fmt.Println("Trying to upgrade...")
-							err := s.doUpgrade(command, svc)
-							if err != nil {
-								fmt.Println(err.Error())
-							} else {
-								if command.Confirm {
-									fmt.Println("Trying to confirm...")
-									err := s.confirmUpgrade(command, svc)
-									url := fmt.Sprintf("%s/env/%s/apps/stacks/%s", s.Config.CattleURL, svc.AccountId, svc.EnvironmentId)
-									if err != nil {
-										fmt.Printf("Unable to upgrade service %s: %s\n", svc.Name, err.Error())
-										message := fmt.Sprintf("Unable to confirm upgrade to `%s`.\nCheck status at <%[2]s|%[1]s>", svc.Name, url)
-										s.slackMessage("danger", message)
-									} else {
-										fmt.Printf("Upgraded %s to %s\n", svc.Name, command.Image)
-										message := fmt.Sprintf("`%[1]s` has been successfully upgraded to `%[2]s` "+
-											"in %[4]s\n View in Rancher here: <%[3]s|%[1]s>", svc.Name, wantedVer, url, envs[svc.AccountId])
-										s.slackMessage("good", message)
-
-									}
-								}
-							}
-							continue
-						} else if s.Config.Debug {
-							log.Printf("Updating enabled from environment [%s], service [%s], but published version [%s] was not newer than current version [%s]\n", envs[svc.AccountId], svc.Name, wantedVer, foundVer)
-						}
-					} else if s.Config.Debug {
-						log.Printf("Updating not enabled for environment %s\n", envs[svc.AccountId])
-					}
-				}
-			}
+// launchConfigs returns the names of the launch configs the candidate upgrades
+func (c Candidate) launchConfigs() []string {
+	names := []string{}
+	if c.Primary {
+		names = append(names, PrimaryLaunchConfig)
+	}
+	return append(names, c.Sidekicks...)
+}
+
+// launchConfig returns a copy of the primary launch config of the service with the image upgraded if it matched
+func (c Candidate) launchConfig(image string) *client.LaunchConfig {
+	launchConfig := *c.Service.LaunchConfig
+	if c.Primary {
+		launchConfig.ImageUuid = image
+	}
+	return &launchConfig
+}
+
+func (c Candidate) event(command UpdateCommand) HookEvent {
+	return HookEvent{
+		ServiceID:   c.Service.Id,
+		Service:     c.Service.Name,
+		StackID:     c.Service.EnvironmentId,
+		Environment: c.Environment,
+		FromImage:   c.FromImage,
+		ToImage:     command.Image,
+		FromVersion: c.FromVersion,
+		ToVersion:   c.ToVersion,
+	}
+}
+
+func (s *ServiceUpdater) upgradeOne(job *Job, command UpdateCommand, c Candidate) {
+	event := c.event(command)
+	target := &JobService{
+		ServiceID:     c.Service.Id,
+		Service:       c.Service.Name,
+		Environment:   event.Environment,
+		StackID:       c.Service.EnvironmentId,
+		FromImage:     event.FromImage,
+		ToImage:       event.ToImage,
+		LaunchConfigs: c.launchConfigs(),
+		Strategy:      strategyFor(command, c.Service),
+		Status:        ServiceUpgrading,
+	}
+	job.add(target)
+	queued := func() {
+		if c, ok := s.recheck(job, target, command, c); ok {
+			s.upgradeTarget(job, target, command, c)
 		}
-		services, _ = services.Next()
+	}
+	if !s.schedule(job, command, []Candidate{c}, []*JobService{target}, queued) {
+		s.upgradeTarget(job, target, command, c)
 	}
 }
 
-func (s *ServiceUpdater) doUpgrade(command UpdateCommand, service client.Service) error {
-	service.LaunchConfig.ImageUuid = command.Image
+// upgradeTarget upgrades one service using its strategy
+func (s *ServiceUpdater) upgradeTarget(job *Job, target *JobService, command UpdateCommand, c Candidate) {
+	svc, event := c.Service, c.event(command)
+	log := s.jobLog(job).forEvent(event)
+	url := fmt.Sprintf("%s/env/%s/apps/stacks/%s", s.Config.CattleURL, svc.AccountId, svc.EnvironmentId)
+	fail := func(status string, err error) {
+		job.update(func() {
+			target.Status = status
+			target.Error = err.Error()
+		})
+		event.Error = err.Error()
+		s.runHooks(HookOnFailure, event)
+	}
+
+	if err := s.runHooks(HookPreUpgrade, event); err != nil {
+		log.warnf("Upgrade aborted: %s", err)
+		s.slackMessage(log, "warning", fmt.Sprintf("Upgrade of `%s` to `%s` was aborted: %s", svc.Name, event.ToVersion, err.Error()))
+		fail(ServiceAborted, err)
+		return
+	}
+
+	log.infof("Trying to upgrade...")
+	s.metrics.upgradeStarted(targetTags(target))
+	var rolledBack bool
+	var err error
+	switch target.Strategy {
+	case StrategyBlueGreen:
+		rolledBack, err = s.upgradeBlueGreen(job, target, command, c, event)
+	case StrategyRolling, StrategyCanary:
+		rolledBack, err = s.upgradeInService(job, target, command, c, event)
+	default:
+		err = fmt.Errorf("Unknown upgrade strategy %s for service %s", target.Strategy, svc.Name)
+	}
+	if err != nil {
+		log.errorf("Unable to upgrade service %s: %s", svc.Name, err)
+		message := fmt.Sprintf("Unable to upgrade `%s` to `%s`: %s\nCheck status at <%[4]s|%[1]s>", svc.Name, event.ToVersion, err.Error(), url)
+		s.slackMessage(log, "danger", message)
+		status := ServiceFailed
+		if rolledBack {
+			status = ServiceRolledBack
+		}
+		fail(status, err)
+		return
+	}
+	if command.Confirm {
+		log.infof("Upgraded %s to %s", svc.Name, command.Image)
+		message := fmt.Sprintf("`%[1]s` has been successfully upgraded to `%[2]s` "+
+			"in %[4]s\n View in Rancher here: <%[3]s|%[1]s>", svc.Name, event.ToVersion, url, event.Environment)
+		s.slackMessage(log, "good", message)
+		job.update(func() {
+			target.Status = ServiceSucceeded
+			target.Stage = ""
+		})
+	} else {
+		job.update(func() { target.Status = ServiceUpgraded })
+	}
+	s.runHooks(HookPostUpgrade, event)
+}
+
+// upgradeInService runs a rolling or canary upgrade of the service and confirms it if requested.
+// It reports whether a failed upgrade was rolled back.
+func (s *ServiceUpdater) upgradeInService(job *Job, target *JobService, command UpdateCommand, c Candidate, event HookEvent) (bool, error) {
+	svc := c.Service
+	log := s.jobLog(job).forEvent(event)
+	if err := s.doUpgrade(log, command, c); err != nil {
+		return false, err
+	}
+	svc.LaunchConfig = c.launchConfig(command.Image)
+	if target.Strategy == StrategyCanary {
+		job.update(func() { target.Stage = StageCanary })
+		if err := s.runCanary(job, target, command, c); err != nil {
+			return target.Stage == StageRolledBack, err
+		}
+	}
+	if !command.Confirm {
+		return false, nil
+	}
+	log.infof("Trying to confirm...")
+	if err := s.confirmUpgrade(log, command, svc, event); err != nil {
+		if policyErr := s.handleFailure(svc); policyErr != nil {
+			log.errorf("Failure policy for service %s failed: %s", svc.Name, policyErr)
+			return false, err
+		}
+		return s.failurePolicy(svc) == FailurePolicyRollback, err
+	}
+	return false, nil
+}
+
+func (s *ServiceUpdater) doUpgrade(log *Logger, command UpdateCommand, c Candidate) error {
+	batchSize, interval, err := batchSettings(command, c.Service)
+	if err != nil {
+		return err
+	}
+	return s.startInService(log, command, c, batchSize, interval)
+}
+
+// startInService starts the in-service upgrade of the candidate in batches
+func (s *ServiceUpdater) startInService(log *Logger, command UpdateCommand, c Candidate, batchSize int64, interval int64) error {
+	service := c.Service
 	upgrade := &client.ServiceUpgrade{}
 	upgrade.InServiceStrategy = &client.InServiceUpgradeStrategy{
-		LaunchConfig:           service.LaunchConfig,
-		SecondaryLaunchConfigs: service.SecondaryLaunchConfigs,
+		BatchSize:              batchSize,
+		IntervalMillis:         interval,
+		LaunchConfig:           c.launchConfig(command.Image),
+		SecondaryLaunchConfigs: upgradedSidekicks(service.SecondaryLaunchConfigs, c.Sidekicks, command.Image),
 		StartFirst:             command.StartFirst,
 	}
 	upgrade.ToServiceStrategy = &client.ToServiceUpgradeStrategy{}
+	log.debugf("Upgrading %s in batches of %d every %dms", service.Name, batchSize, interval)
 	_, err := s.service.ActionUpgrade(&service, upgrade)
 	return err
 }
 
-func (s *ServiceUpdater) confirmUpgrade(command UpdateCommand, service client.Service) error {
-	srv, err := utils.Retry(func() (interface{}, error) {
-		s, e := s.service.ById(service.Id)
-		if e != nil {
-			return nil, e
-		}
-		if s.State != "upgraded" {
-			return nil, fmt.Errorf("Service not upgraded: %s\n", s.State)
-		}
-		return s, nil
-	}, time.Duration(command.Timeout)*time.Second, 3*time.Second)
+func (s *ServiceUpdater) confirmUpgrade(log *Logger, command UpdateCommand, service client.Service, event HookEvent) error {
+	start := time.Now()
+	srv, err := s.awaitUpgraded(command, service)
 	if err != nil {
 		return err
 	}
 
-	srv, err = s.service.ActionFinishupgrade(srv.(*client.Service))
+	if err := s.runHooks(HookPreFinish, event); err != nil {
+		return err
+	}
+
+	srv, err = s.service.ActionFinishupgrade(srv)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Finished upgrade on %s\n", srv.(*client.Service).Name)
+	log.infof("Finished upgrade on %s", srv.Name)
+	s.metrics.confirmed(metricTags{
+		Environment: event.Environment,
+		Stack:       service.EnvironmentId,
+		Service:     service.Name,
+		Image:       strings.TrimPrefix(event.ToImage, "docker:"),
+	}, time.Since(start))
 	return err
 }
 
-func (s *ServiceUpdater) slackMessage(status string, message string) {
+func (s *ServiceUpdater) slackMessage(log *Logger, status string, message string) {
 	if s.Config.SlackWebhookURL != "" {
 		attachment := slack.Attachment{Color: &status, Text: &message}
 		mrkdwn := "text"
@@ -259,10 +885,14 @@ func (s *ServiceUpdater) slackMessage(status string, message string) {
 			Attachments: []slack.Attachment{attachment},
 		}
 		printable, _ := json.Marshal(payload)
-		fmt.Println(string(printable))
+		log.debugf("Sending Slack message: %s", string(printable))
+		span := s.span.child("notify slack", spanClient, "slack.status", status)
 		err := slack.Send(s.Config.SlackWebhookURL, "", payload)
 		if len(err) > 0 {
-			fmt.Printf("error sending Slack message: %s\n", err)
+			log.errorf("Unable to send Slack message: %s", err)
+			span.finish(err[0])
+			return
 		}
+		span.finish(nil)
 	}
 }
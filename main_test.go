@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rancher/go-rancher/client"
 )
@@ -19,25 +22,229 @@ func Test_basic(t *testing.T) {
 
 }
 
-type mockService struct{}
-type mockAccount struct{}
+func newTestUpdater(services ...client.Service) (*ServiceUpdater, *mockService) {
+	service := &mockService{services: services, state: "upgraded", health: "healthy", states: map[string]string{}}
+	return &ServiceUpdater{
+		Config: &Config{
+			EnableLabel:      "autoupdate.enable",
+			EnvironmentNames: []string{".*"},
+			FailurePolicy:    FailurePolicyNone,
+		},
+		service:    service,
+		account:    &mockAccount{},
+		readiness:  &Readiness{},
+		base:       &mockBase{containers: []client.Container{{Name: "api-1", State: "running", ImageUuid: "docker:myorg/api:2.0"}}},
+		jobStore:   newJobStore(),
+		blueGreen:  &BlueGreenStore{entries: map[string]*BlueGreen{}},
+		promotions: newPromotionStore(),
+		freezes:    &FreezeStore{freezes: map[string]*Freeze{}},
+		queue:      &UpgradeQueue{},
+		history:    &HistoryStore{},
+		holds:      &HoldStore{holds: map[string]*Hold{}},
+		pauses:     &PauseStore{pauses: map[string]*Pause{}},
+		metrics:    newMetrics(),
+	}, service
+}
+
+func testService(labels map[string]interface{}) client.Service {
+	labels["autoupdate.enable"] = "true"
+	return client.Service{
+		Resource:  client.Resource{Id: "1s1"},
+		Name:      "api",
+		AccountId: "1a1",
+		Scale:     2,
+		LaunchConfig: &client.LaunchConfig{
+			ImageUuid: "docker:myorg/api:1.0",
+			Labels:    labels,
+		},
+	}
+}
+
+func Test_upgradeService(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if job.Status != JobSucceeded || len(job.Services) != 1 || job.Services[0].Status != ServiceSucceeded {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if len(service.finished) != 1 {
+		t.Errorf("expected upgrade to be finished")
+	}
+}
+
+func Test_upgradeServiceCanaryResume(t *testing.T) {
+	canaryCheckInterval = 10 * time.Millisecond
+	updater, service := newTestUpdater(testService(map[string]interface{}{
+		strategyLabel:   StrategyCanary,
+		canaryBakeLabel: "1",
+		batchSizeLabel:  "2",
+	}))
+	service.setState("1s1", "upgrading")
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	target := job.Services[0]
+	if job.Status != JobSucceeded || target.Status != ServiceSucceeded || target.Stage != "" {
+		t.Fatalf("expected the canary to pass, got %+v", target)
+	}
+	if len(service.upgrades) != 2 {
+		t.Fatalf("expected the held upgrade to be resumed, got %d upgrades", len(service.upgrades))
+	}
+	if resumed := service.upgrades[1].InServiceStrategy; resumed.BatchSize != 2 || resumed.IntervalMillis != 0 {
+		t.Errorf("expected the remaining batches to use the rolling settings, got %+v", resumed)
+	}
+	if len(service.finished) != 1 || len(service.rolledBack) != 0 {
+		t.Errorf("expected the upgrade to be finished, got %v %v", service.finished, service.rolledBack)
+	}
+}
+
+func Test_upgradeServiceCanary(t *testing.T) {
+	canaryCheckInterval = 10 * time.Millisecond
+	updater, service := newTestUpdater(testService(map[string]interface{}{
+		strategyLabel:   StrategyCanary,
+		canaryBakeLabel: "1",
+	}))
+	service.state = "upgrading"
+	service.health = "unhealthy"
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if service.upgrades[0].InServiceStrategy.BatchSize != 1 || service.upgrades[0].InServiceStrategy.IntervalMillis <= 2000 {
+		t.Errorf("expected canary to roll one container and hold past the bake period, got %+v", service.upgrades[0].InServiceStrategy)
+	}
+	target := job.Services[0]
+	if job.Status != JobFailed || target.Status != ServiceRolledBack || target.Stage != StageRolledBack {
+		t.Fatalf("expected unhealthy canary to be rolled back, got %+v", target)
+	}
+	if len(service.rolledBack) != 1 {
+		t.Errorf("expected rollback")
+	}
+}
+
+type mockService struct {
+	services    []client.Service
+	states      map[string]string
+	state       string
+	health      string
+	upgrades    []*client.ServiceUpgrade
+	finished    []string
+	rolledBack  []string
+	deactivated []string
+	removed     []string
+	finishErr   map[string]error
+	mu          sync.Mutex
+}
+type mockAccount struct {
+	accounts []client.Account
+}
 
 func (a *mockService) ById(id string) (*client.Service, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, svc := range a.services {
+		if svc.Id == id {
+			svc.State = a.state
+			if state, ok := a.states[id]; ok {
+				svc.State = state
+			}
+			svc.HealthState = a.health
+			return &svc, nil
+		}
+	}
 	return nil, nil
 }
 
 func (a *mockService) List(opts *client.ListOpts) (*client.ServiceCollection, error) {
-	return nil, nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.services == nil {
+		return nil, nil
+	}
+	return &client.ServiceCollection{Data: a.services}, nil
+}
+
+func (a *mockService) Create(service *client.Service) (*client.Service, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	service.Id = fmt.Sprintf("1s%d", len(a.services)+1)
+	a.services = append(a.services, *service)
+	a.states[service.Id] = "active"
+	return service, nil
+}
+
+func (a *mockService) ActionActivate(service *client.Service) (*client.Service, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return service, nil
+}
+
+func (a *mockService) ActionDeactivate(service *client.Service) (*client.Service, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.deactivated = append(a.deactivated, service.Id)
+	a.states[service.Id] = "inactive"
+	return service, nil
+}
+
+func (a *mockService) ActionRemove(service *client.Service) (*client.Service, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.removed = append(a.removed, service.Id)
+	return service, nil
+}
+
+func (a *mockService) ActionCancelupgrade(service *client.Service) (*client.Service, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.states[service.Id] = "canceled-upgrade"
+	return service, nil
 }
 
 func (a *mockService) ActionFinishupgrade(service *client.Service) (*client.Service, error) {
-	return nil, nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.finishErr[service.Id]; err != nil {
+		return nil, err
+	}
+	a.finished = append(a.finished, service.Id)
+	a.states[service.Id] = "active"
+	return service, nil
+}
+
+func (a *mockService) ActionRollback(service *client.Service) (*client.Service, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.states[service.Id] == "upgrading" {
+		return nil, fmt.Errorf("Bad response statusCode [422]. Status [422 status 422]. Body: [code=InvalidState]")
+	}
+	a.rolledBack = append(a.rolledBack, service.Id)
+	a.states[service.Id] = "active"
+	return service, nil
 }
 
 func (a *mockService) ActionUpgrade(service *client.Service, serviceUpgrade *client.ServiceUpgrade) (*client.Service, error) {
-	return nil, nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.upgrades = append(a.upgrades, serviceUpgrade)
+	if serviceUpgrade.ToServiceStrategy != nil && serviceUpgrade.ToServiceStrategy.ToServiceId != "" {
+		a.states[service.Id] = "upgraded"
+	}
+	if a.states[service.Id] == "canceled-upgrade" {
+		a.states[service.Id] = "upgraded"
+	}
+	return service, nil
+}
+
+func (a *mockService) setState(id string, state string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.states[id] = state
 }
 
 func (a *mockAccount) List(opts *client.ListOpts) (*client.AccountCollection, error) {
-	return nil, nil
+	if a.accounts != nil {
+		return &client.AccountCollection{Data: a.accounts}, nil
+	}
+	return &client.AccountCollection{Data: []client.Account{{Resource: client.Resource{Id: "1a1"}, Name: "dev"}}}, nil
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	metricTriggers         = "rancher_updater_triggers_total"
+	metricUpgradesStarted  = "rancher_updater_upgrades_started_total"
+	metricUpgradesFinished = "rancher_updater_upgrades_finished_total"
+	metricConfirmDuration  = "rancher_updater_confirm_duration_seconds"
+	metricRancherDuration  = "rancher_updater_rancher_request_duration_seconds"
+	metricRancherErrors    = "rancher_updater_rancher_errors_total"
+	metricQueueDepth       = "rancher_updater_queue_depth"
+	metricLastSuccess      = "rancher_updater_last_success_timestamp_seconds"
+)
+
+// metricInfo is the type and help of a metric in the Prometheus text format
+type metricInfo struct {
+	kind    string
+	help    string
+	buckets []float64
+}
+
+var metricInfos = map[string]metricInfo{
+	metricTriggers:         {"counter", "Triggers received by source and outcome.", nil},
+	metricUpgradesStarted:  {"counter", "Service upgrades started by environment.", nil},
+	metricUpgradesFinished: {"counter", "Service upgrades finished by environment and outcome.", nil},
+	metricConfirmDuration:  {"histogram", "Time from waiting for an upgraded service until its upgrade is finished.", []float64{5, 15, 30, 60, 120, 300, 600, 1800}},
+	metricRancherDuration:  {"histogram", "Latency of Rancher API calls by operation.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}},
+	metricRancherErrors:    {"counter", "Failed Rancher API calls by operation.", nil},
+	metricQueueDepth:       {"gauge", "Upgrades waiting for a maintenance window, a freeze or a pause to end.", nil},
+	metricLastSuccess:      {"gauge", "Unix time of the last successful upgrade by service.", nil},
+}
+
+// histogram counts observations in cumulative buckets
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics collects the metrics of the updater for /metrics and sends them to StatsD, if configured.
+// A nil Metrics collects nothing.
+type Metrics struct {
+	mu         sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+	statsd     *StatsD
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// labels renders label pairs, e.g. labels("environment", "dev") is {environment="dev"}
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var rendered []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		rendered = append(rendered, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return "{" + strings.Join(rendered, ",") + "}"
+}
+
+func (m *Metrics) add(name string, value float64, pairs ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labels(pairs...)] += value
+}
+
+func (m *Metrics) set(name string, value float64, pairs ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labels(pairs...)] = value
+}
+
+func (m *Metrics) observe(name string, value float64, pairs ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	key := labels(pairs...)
+	h := m.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricInfos[name].buckets))}
+		m.histograms[name][key] = h
+	}
+	for i, bound := range metricInfos[name].buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (m *Metrics) sink() *StatsD {
+	if m == nil {
+		return nil
+	}
+	return m.statsd
+}
+
+// triggerReceived counts a trigger by its source and whether it was accepted
+func (m *Metrics) triggerReceived(source string, outcome string) {
+	m.add(metricTriggers, 1, "source", source, "outcome", outcome)
+	m.sink().count("triggers", "source", source, "outcome", outcome)
+}
+
+// upgradeStarted counts an upgrade started in the environment
+func (m *Metrics) upgradeStarted(tags metricTags) {
+	m.add(metricUpgradesStarted, 1, "environment", tags.Environment)
+	m.sink().count("upgrades.started", tags.pairs()...)
+}
+
+// upgradeFinished counts an upgrade by its final status, and records when the service was last upgraded successfully
+func (m *Metrics) upgradeFinished(tags metricTags, outcome string, at time.Time) {
+	m.add(metricUpgradesFinished, 1, "environment", tags.Environment, "outcome", outcome)
+	m.sink().count("upgrades.finished", append(tags.pairs(), "outcome", outcome)...)
+	if outcome == ServiceSucceeded || outcome == ServiceUpgraded {
+		m.set(metricLastSuccess, float64(at.Unix()), "service", tags.Service, "environment", tags.Environment)
+		m.sink().gauge("last_success", float64(at.Unix()), tags.pairs()...)
+	}
+}
+
+// confirmed records how long an upgrade took until it was confirmed
+func (m *Metrics) confirmed(tags metricTags, d time.Duration) {
+	m.observe(metricConfirmDuration, d.Seconds())
+	m.sink().timing("confirm.duration", d, tags.pairs()...)
+}
+
+// rancherCall records the latency and the outcome of a Rancher API call
+func (m *Metrics) rancherCall(operation string, d time.Duration, err error) {
+	m.observe(metricRancherDuration, d.Seconds(), "operation", operation)
+	m.sink().timing("rancher.request", d, "operation", operation)
+	if err != nil {
+		m.add(metricRancherErrors, 1, "operation", operation)
+		m.sink().count("rancher.errors", "operation", operation)
+	}
+}
+
+// queueDepth records the number of queued upgrades
+func (m *Metrics) queueDepth(depth int) {
+	m.set(metricQueueDepth, float64(depth))
+	m.sink().gauge("queue.depth", float64(depth))
+}
+
+// withLabel adds a label to rendered labels
+func withLabel(rendered string, pair string) string {
+	if rendered == "" {
+		return "{" + pair + "}"
+	}
+	return rendered[:len(rendered)-1] + "," + pair + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write writes the metrics in the Prometheus text format
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(metricInfos))
+	for name := range metricInfos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := metricInfos[name]
+		if len(m.values[name]) == 0 && len(m.histograms[name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, info.help, name, info.kind)
+		for _, key := range sortedKeys(m.values[name]) {
+			fmt.Fprintf(w, "%s%s %v\n", name, key, m.values[name][key])
+		}
+		keys := make([]string, 0, len(m.histograms[name]))
+		for key := range m.histograms[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h := m.histograms[name][key]
+			for i, bound := range info.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, fmt.Sprintf(`le="%v"`, bound)), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, `le="+Inf"`), h.count)
+			fmt.Fprintf(w, "%s_sum%s %v\n", name, key, h.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+}
+
+// metricsHandler handles GET /metrics in the Prometheus text format
+func (s *ServiceUpdater) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	s.metrics.set(metricQueueDepth, float64(s.queue.len()))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_labels(t *testing.T) {
+	if l := labels("service", `a"b`, "environment", "dev"); l != `{service="a\"b",environment="dev"}` {
+		t.Errorf("unexpected labels %s", l)
+	}
+	if l := withLabel(labels(), `le="1"`); l != `{le="1"}` {
+		t.Errorf("unexpected labels %s", l)
+	}
+}
+
+func Test_metrics(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	updater.service = instrumentedService{service, instrumentation{metrics: updater.metrics}}
+	updater.upgrade(httptest.NewRecorder(), httptest.NewRequest("POST", "/upgrade", strings.NewReader(`{"docker_image": "myorg/api:2.0", "confirm": true, "timeout": 1}`)))
+	updater.upgrade(httptest.NewRecorder(), httptest.NewRequest("POST", "/upgrade", strings.NewReader(`{}`)))
+	for i := 0; i < 100 && len(updater.history.list(HistoryFilter{})) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	updater.metrics.rancherCall("service.upgrade", time.Second, fmt.Errorf("boom"))
+
+	w := httptest.NewRecorder()
+	updater.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE rancher_updater_triggers_total counter",
+		`rancher_updater_triggers_total{source="api",outcome="accepted"} 1`,
+		`rancher_updater_triggers_total{source="api",outcome="rejected"} 1`,
+		`rancher_updater_upgrades_started_total{environment="dev"} 1`,
+		`rancher_updater_upgrades_finished_total{environment="dev",outcome="succeeded"} 1`,
+		"# TYPE rancher_updater_confirm_duration_seconds histogram",
+		`rancher_updater_confirm_duration_seconds_bucket{le="+Inf"} 1`,
+		"rancher_updater_confirm_duration_seconds_count 1",
+		`rancher_updater_rancher_request_duration_seconds_bucket{operation="service.upgrade",le="0.5"} 1`,
+		`rancher_updater_rancher_request_duration_seconds_count{operation="service.upgrade"} 2`,
+		`rancher_updater_rancher_request_duration_seconds_count{operation="service.list"} 1`,
+		`rancher_updater_rancher_errors_total{operation="service.upgrade"} 1`,
+		"rancher_updater_queue_depth 0",
+		`rancher_updater_last_success_timestamp_seconds{service="api",environment="dev"} `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	//PauseQueue queues the upgrades of triggers received while paused until the pause is lifted
+	PauseQueue = "queue"
+	//PauseDrop records the triggers received while paused without upgrading anything
+	PauseDrop = "drop"
+
+	pausesFile = "pauses.json"
+)
+
+// Pause stops the automated upgrades of every environment, or of the environments matching a pattern
+type Pause struct {
+	Environments string    `json:"environments,omitempty"`
+	Policy       string    `json:"policy"`
+	Reason       string    `json:"reason,omitempty"`
+	By           string    `json:"by"`
+	Created      time.Time `json:"created"`
+}
+
+// PauseStore keeps the pauses by environment pattern, the global pause having an empty pattern.
+// They are saved to pauses.json in the data directory, if one is configured.
+type PauseStore struct {
+	mu     sync.Mutex
+	pauses map[string]*Pause
+	path   string
+}
+
+// openPauses loads the pauses saved in the data directory. Without a data directory the pauses
+// are kept in memory only.
+func openPauses(dir string) (*PauseStore, error) {
+	ps := &PauseStore{pauses: make(map[string]*Pause)}
+	if dir == "" {
+		return ps, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ps.path = filepath.Join(dir, pausesFile)
+	content, err := ioutil.ReadFile(ps.path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pauses []*Pause
+	if err := json.Unmarshal(content, &pauses); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", ps.path, err)
+	}
+	for _, p := range pauses {
+		ps.pauses[p.Environments] = p
+	}
+	return ps, nil
+}
+
+// reason describes the pause for plan and job output
+func (p *Pause) reason() string {
+	reason := fmt.Sprintf("Paused by %s", p.By)
+	if p.Environments != "" {
+		reason = fmt.Sprintf("%s in %s", reason, p.Environments)
+	}
+	if p.Reason != "" {
+		reason = fmt.Sprintf("%s: %s", reason, p.Reason)
+	}
+	return reason
+}
+
+// list returns the pauses, the global pause first
+func (ps *PauseStore) list() []*Pause {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.sorted()
+}
+
+// sorted returns the pauses, the global pause first. It must be called with the lock held.
+func (ps *PauseStore) sorted() []*Pause {
+	pauses := make([]*Pause, 0, len(ps.pauses))
+	for _, p := range ps.pauses {
+		pauses = append(pauses, p)
+	}
+	sort.Slice(pauses, func(i, k int) bool { return pauses[i].Environments < pauses[k].Environments })
+	return pauses
+}
+
+// save writes the pauses to the pauses file, replacing it atomically. It must be called with the lock held.
+func (ps *PauseStore) save() error {
+	if ps.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(ps.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ps.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ps.path)
+}
+
+// add pauses the environments of the pause, replacing a previous pause of the same environments
+func (ps *PauseStore) add(p *Pause) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.pauses[p.Environments] = p
+	return ps.save()
+}
+
+// remove lifts the pause of the environments and reports whether there was one
+func (ps *PauseStore) remove(environments string) (bool, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.pauses[environments]; !ok {
+		return false, nil
+	}
+	delete(ps.pauses, environments)
+	return true, ps.save()
+}
+
+// active returns the pause applying to the environment, the global pause taking precedence
+func (ps *PauseStore) active(env string) *Pause {
+	for _, p := range ps.list() {
+		if p.Environments == "" || utils.EnvironmentEnabled(env, []string{p.Environments}) {
+			return p
+		}
+	}
+	return nil
+}
+
+// dropped returns the pause dropping the upgrades of any of the candidates, if there is one
+func (s *ServiceUpdater) dropped(candidates []Candidate) *Pause {
+	for _, c := range candidates {
+		if p := s.pauses.active(c.Environment); p != nil && p.Policy == PauseDrop {
+			return p
+		}
+	}
+	return nil
+}
+
+// pauseHandler handles POST /pause and POST /resume
+func (s *ServiceUpdater) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	if r.Method != "POST" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	var p Pause
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			utils.SendError(w, err.Error(), 400)
+			return
+		}
+	}
+	scope := p.Environments
+	if scope == "" {
+		scope = "all environments"
+	}
+	if r.URL.Path == "/resume" {
+		resumed, err := s.pauses.remove(p.Environments)
+		if err != nil {
+			utils.SendError(w, err.Error(), 500)
+			return
+		}
+		if !resumed {
+			utils.SendError(w, "Not paused", 404)
+			return
+		}
+		s.log.infof("Resumed upgrades of %s", scope)
+		s.audit.add(AuditPause, caller(r), map[string]interface{}{"action": "resumed", "environments": p.Environments})
+		s.slackMessage(s.log, "good", fmt.Sprintf("Upgrades of %s were resumed", scope))
+		go s.drainQueue(time.Now().UTC())
+		w.WriteHeader(204)
+		return
+	}
+	if _, err := regexp.Compile(p.Environments); err != nil {
+		utils.SendError(w, fmt.Sprintf("Invalid environments pattern: %s", err), 400)
+		return
+	}
+	if p.Policy == "" {
+		p.Policy = s.Config.PausePolicy
+	}
+	if p.Policy != PauseQueue && p.Policy != PauseDrop {
+		utils.SendError(w, fmt.Sprintf("Unknown pause policy %s", p.Policy), 400)
+		return
+	}
+	p.By, p.Created = caller(r), time.Now().UTC()
+	if err := s.pauses.add(&p); err != nil {
+		utils.SendError(w, err.Error(), 500)
+		return
+	}
+	s.log.infof("Paused upgrades of %s, triggers are %s: %s", scope, map[string]string{PauseQueue: "queued", PauseDrop: "dropped"}[p.Policy], p.Reason)
+	s.audit.add(AuditPause, p.By, map[string]interface{}{"action": "paused", "environments": p.Environments, "policy": p.Policy, "reason": p.Reason})
+	s.slackMessage(s.log, "warning", fmt.Sprintf("Upgrades of %s were paused: %s", scope, p.reason()))
+	sendJSON(w, p, 201)
+}
+
+// statusHandler handles GET /status, reporting the pauses and the number of queued upgrades
+func (s *ServiceUpdater) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	pauses := s.pauses.list()
+	sendJSON(w, map[string]interface{}{
+		"paused": len(pauses) > 0 && pauses[0].Environments == "",
+		"pauses": pauses,
+		"queued": s.queue.len(),
+	}, 200)
+}
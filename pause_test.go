@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_pause(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pauses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	updater.Config.PausePolicy = PauseQueue
+	if updater.pauses, err = openPauses(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	updater.pauseHandler(w, httptest.NewRequest("POST", "/pause", strings.NewReader(`{"reason": "rancher is unstable"}`)))
+	if w.Code != 201 {
+		t.Fatalf("expected pause to be created, got %d %s", w.Code, w.Body)
+	}
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	if job.Status != JobQueued || job.Services[0].Reason != "Paused by 192.0.2.1: rancher is unstable" || len(service.upgrades) != 0 {
+		t.Fatalf("expected the upgrade to be queued while paused, got %+v %+v", job, job.Services[0])
+	}
+	if plan, _ := updater.plan(UpdateCommand{Image: "myorg/api:2.0"}); plan[0].Decision != DecisionQueue {
+		t.Errorf("expected the plan to queue the upgrade, got %+v", plan[0])
+	}
+	updater.drainQueue(time.Now().Add(time.Hour))
+	if updater.queue.len() != 1 {
+		t.Error("expected the upgrade to stay queued until resumed")
+	}
+
+	w = httptest.NewRecorder()
+	updater.statusHandler(w, httptest.NewRequest("GET", "/status", nil))
+	var status struct {
+		Paused bool     `json:"paused"`
+		Pauses []*Pause `json:"pauses"`
+		Queued int      `json:"queued"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || !status.Paused || len(status.Pauses) != 1 || status.Queued != 1 {
+		t.Errorf("unexpected status %+v %v", status, err)
+	}
+	if reopened, _ := openPauses(dir); reopened.active("dev") == nil {
+		t.Error("expected the pause to be saved")
+	}
+
+	w = httptest.NewRecorder()
+	updater.pauseHandler(w, httptest.NewRequest("POST", "/resume", nil))
+	if w.Code != 204 {
+		t.Fatalf("expected upgrades to be resumed, got %d", w.Code)
+	}
+	for i := 0; i < 100 && job.queued(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForJob(t, job)
+	if job.Status != JobSucceeded || len(service.upgrades) != 1 {
+		t.Errorf("expected the queued upgrade to run once resumed, got %+v", job)
+	}
+	if reopened, _ := openPauses(dir); reopened.active("dev") != nil {
+		t.Error("expected the resume to be saved")
+	}
+}
+
+func Test_pauseDrop(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	updater.Config.PausePolicy = PauseQueue
+	w := httptest.NewRecorder()
+	updater.pauseHandler(w, httptest.NewRequest("POST", "/pause", strings.NewReader(`{"environments": "^dev$", "policy": "drop"}`)))
+	if w.Code != 201 {
+		t.Fatalf("expected pause to be created, got %d %s", w.Code, w.Body)
+	}
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	if job.Status != JobFailed || job.Services[0].Status != ServiceDropped || len(service.upgrades) != 0 || updater.queue.len() != 0 {
+		t.Errorf("expected the upgrade to be dropped, got %+v %+v", job, job.Services[0])
+	}
+	if records := updater.history.list(HistoryFilter{}); len(records) != 1 || records[0].Outcome != ServiceDropped {
+		t.Errorf("expected the dropped trigger to be recorded, got %+v", records)
+	}
+	if plan, _ := updater.plan(UpdateCommand{Image: "myorg/api:2.0"}); plan[0].Decision != DecisionSkip {
+		t.Errorf("expected the plan to skip the upgrade, got %+v", plan[0])
+	}
+
+	w = httptest.NewRecorder()
+	updater.statusHandler(w, httptest.NewRequest("GET", "/status", nil))
+	if !strings.Contains(w.Body.String(), `"paused":false`) {
+		t.Errorf("expected an environment pause not to be global, got %s", w.Body)
+	}
+	for body, code := range map[string]int{`{"policy": "ignore"}`: 400, `{"environments": "("}`: 400} {
+		w = httptest.NewRecorder()
+		updater.pauseHandler(w, httptest.NewRequest("POST", "/pause", strings.NewReader(body)))
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d", body, code, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	updater.pauseHandler(w, httptest.NewRequest("POST", "/resume", nil))
+	if w.Code != 404 {
+		t.Errorf("expected resuming without a global pause to fail, got %d", w.Code)
+	}
+}
+
+func Test_pausesConcurrentSave(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pauses")
+	defer os.RemoveAll(dir)
+	ps, err := openPauses(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			env := fmt.Sprintf("env%d", i%5)
+			if err := ps.add(&Pause{Environments: env, Policy: PauseQueue}); err != nil {
+				t.Error(err)
+			}
+			if i%2 == 0 {
+				if _, err := ps.remove(env); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	loaded, err := openPauses(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.list()) != len(ps.list()) {
+		t.Errorf("expected the saved pauses %d to match the pauses %d", len(loaded.list()), len(ps.list()))
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	//DecisionUpgrade is a service that would be upgraded right away
+	DecisionUpgrade = "upgrade"
+	//DecisionQueue is a service that would be queued until its maintenance window opens
+	DecisionQueue = "queue"
+	//DecisionApproval is a service that would wait for approval
+	DecisionApproval = "approval"
+	//DecisionSkip is a service that would not be upgraded
+	DecisionSkip = "skip"
+	//DecisionFail is a service whose upgrade would fail
+	DecisionFail = "fail"
+)
+
+// PlanEntry is the decision an upgrade command would take for one service
+type PlanEntry struct {
+	ServiceID     string     `json:"service_id"`
+	Service       string     `json:"service"`
+	Environment   string     `json:"environment"`
+	StackID       string     `json:"stack_id"`
+	CurrentImage  string     `json:"current_image"`
+	TargetImage   string     `json:"target_image"`
+	LaunchConfigs []string   `json:"launch_configs,omitempty"`
+	Strategy      string     `json:"strategy,omitempty"`
+	Decision      string     `json:"decision"`
+	Reason        string     `json:"reason,omitempty"`
+	Scheduled     *time.Time `json:"scheduled,omitempty"`
+}
+
+// plan runs the matching and the policies of the command without upgrading anything
+func (s *ServiceUpdater) plan(command UpdateCommand) ([]PlanEntry, error) {
+	images := command.Images
+	if len(images) == 0 {
+		images = []string{command.Image}
+	}
+	entries := []PlanEntry{}
+	now := time.Now().UTC()
+	for _, image := range images {
+		imageCommand := command
+		imageCommand.Image = image
+		if !strings.HasPrefix(imageCommand.Image, "docker:") {
+			imageCommand.Image = fmt.Sprintf("docker:%s", imageCommand.Image)
+		}
+		matches, err := s.matchServices(imageCommand)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			entry := PlanEntry{
+				ServiceID:    m.Service.Id,
+				Service:      m.Service.Name,
+				Environment:  m.Environment,
+				StackID:      m.Service.EnvironmentId,
+				CurrentImage: m.FromImage,
+				TargetImage:  imageCommand.Image,
+				Decision:     DecisionSkip,
+				Reason:       m.Reason,
+			}
+			if m.Reason == "" {
+				entry.LaunchConfigs = m.launchConfigs()
+				entry.Strategy = strategyFor(imageCommand, m.Service)
+				entry.Decision, entry.Reason, entry.Scheduled = s.policyDecision(imageCommand, m.Candidate, entry.Strategy, now)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// policyDecision applies the policies of the pipeline to a candidate
+func (s *ServiceUpdater) policyDecision(command UpdateCommand, c Candidate, strategy string, now time.Time) (string, string, *time.Time) {
+	switch strategy {
+	case StrategyRolling, StrategyCanary, StrategyBlueGreen:
+		if _, _, err := batchSettings(command, c.Service); err != nil {
+			return DecisionFail, err.Error(), nil
+		}
+	case StrategyStack:
+	default:
+		return DecisionFail, fmt.Sprintf("Unknown upgrade strategy %s", strategy), nil
+	}
+	if len(command.Images) > 0 && strategy != StrategyRolling && strategy != StrategyCanary {
+		return DecisionFail, fmt.Sprintf("Releases only support rolling and canary upgrades, not %s", strategy), nil
+	}
+	if p := s.dropped([]Candidate{c}); p != nil {
+		return DecisionSkip, fmt.Sprintf("Dropped while paused: %s", p.reason()), nil
+	}
+	reason, at, err := s.blocked(c, now)
+	if err != nil {
+		return DecisionFail, err.Error(), nil
+	}
+	var scheduled *time.Time
+	if reason != "" && !at.IsZero() {
+		scheduled = &at
+	}
+	if utils.EnvironmentEnabled(c.Environment, s.Config.RequiresApproval) {
+		approval := fmt.Sprintf("Requires approval for %s", c.Environment)
+		if reason != "" {
+			approval = fmt.Sprintf("%s, then: %s", approval, reason)
+		}
+		return DecisionApproval, approval, scheduled
+	}
+	if reason != "" {
+		return DecisionQueue, reason, scheduled
+	}
+	return DecisionUpgrade, "", nil
+}
+
+func (s *ServiceUpdater) planHandler(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	if r.Method != "POST" {
+		utils.SendError(w, "Method not allowed", 405)
+		return
+	}
+	command, err := s.decodeCommand(r)
+	if err != nil {
+		utils.SendError(w, err.Error(), 400)
+		return
+	}
+	entries, err := s.plan(command)
+	if err != nil {
+		utils.SendError(w, err.Error(), 500)
+		return
+	}
+	sendJSON(w, entries, 200)
+}
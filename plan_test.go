@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func Test_plan(t *testing.T) {
+	api := testService(map[string]interface{}{})
+	web := testService(map[string]interface{}{})
+	web.Id, web.Name, web.LaunchConfig.ImageUuid = "1s2", "web", "docker:myorg/web:1.0"
+	newest := testService(map[string]interface{}{})
+	newest.Id, newest.Name, newest.LaunchConfig.ImageUuid = "1s3", "api-next", "docker:myorg/api:3.0"
+	prod := testService(map[string]interface{}{batchSizeLabel: "5"})
+	prod.Id, prod.AccountId = "1s4", "1a2"
+	disabled := client.Service{Resource: client.Resource{Id: "1s5"}, Name: "db", LaunchConfig: &client.LaunchConfig{ImageUuid: "docker:postgres:9"}}
+	updater, service := newTestUpdater(api, web, newest, prod, disabled)
+	updater.account = &mockAccount{accounts: []client.Account{
+		{Resource: client.Resource{Id: "1a1"}, Name: "dev"},
+		{Resource: client.Resource{Id: "1a2"}, Name: "production"},
+	}}
+	updater.Config.RequiresApproval = []string{"production"}
+
+	w := httptest.NewRecorder()
+	updater.planHandler(w, httptest.NewRequest("POST", "/plan", strings.NewReader(`{"docker_image": "myorg/api:2.0"}`)))
+	var entries []PlanEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected response %d %v", w.Code, err)
+	}
+	decisions := make(map[string]string)
+	for _, e := range entries {
+		decisions[e.ServiceID] = e.Decision + ": " + e.Reason
+	}
+	expected := map[string]string{
+		"1s1": "upgrade: ",
+		"1s2": "skip: Image does not match",
+		"1s3": "skip: Published version 2.0 is not newer than current version 3.0",
+		"1s4": "fail: Batch size 5 for api is larger than its scale 2",
+	}
+	if len(decisions) != len(expected) {
+		t.Errorf("expected %d entries, got %v", len(expected), decisions)
+	}
+	for id, decision := range expected {
+		if decisions[id] != decision {
+			t.Errorf("%s: expected %q, got %q", id, decision, decisions[id])
+		}
+	}
+	if entries[0].TargetImage != "docker:myorg/api:2.0" || entries[0].CurrentImage != "docker:myorg/api:1.0" {
+		t.Errorf("unexpected images %+v", entries[0])
+	}
+
+	updater.service.(*mockService).services[3].LaunchConfig.Labels = map[string]interface{}{"autoupdate.enable": "true"}
+	plan, _ := updater.plan(UpdateCommand{Image: "docker:myorg/api:2.0"})
+	if plan[3].Decision != DecisionApproval {
+		t.Errorf("expected production to require approval, got %+v", plan[3])
+	}
+	if len(service.upgrades) != 0 {
+		t.Error("expected plan not to upgrade anything")
+	}
+}
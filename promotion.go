@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	//PromotionSoaking is a promotion waiting for the soak period to pass
+	PromotionSoaking = "soaking"
+	//PromotionAwaitingApproval is a promotion that soaked and waits to be approved
+	PromotionAwaitingApproval = "awaiting_approval"
+	//PromotionPromoted is a promotion whose upgrade of the next environment was started
+	PromotionPromoted = "promoted"
+	//PromotionFailed is a promotion whose services became unhealthy while soaking
+	PromotionFailed = "failed"
+	//PromotionRejected is a promotion that was rejected
+	PromotionRejected = "rejected"
+
+	promotionApproval = "approval"
+	promotionsFile    = "promotions.json"
+)
+
+var promotionCheckInterval = 30 * time.Second
+
+// PromotionRule promotes what was upgraded in one environment to the next one
+type PromotionRule struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Soak     time.Duration `json:"soak"`
+	Approval bool          `json:"approval"`
+}
+
+// Promotion is the promotion of one image or release from one environment to the next
+type Promotion struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Status    string    `json:"status"`
+	SourceJob string    `json:"source_job"`
+	Job       string    `json:"job,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Created   time.Time `json:"created"`
+	PromoteAt time.Time `json:"promote_at"`
+	Updated   time.Time `json:"updated"`
+
+	command  UpdateCommand
+	services []string
+	mu       sync.Mutex
+}
+
+// StoredPromotion is a promotion as saved in the data directory, together with what it promotes
+type StoredPromotion struct {
+	Promotion *Promotion    `json:"promotion"`
+	Command   UpdateCommand `json:"command"`
+	Services  []string      `json:"services"`
+}
+
+// PromotionStore keeps the most recent promotions and saves them to promotions.json in the
+// data directory, if one is configured
+type PromotionStore struct {
+	mu         sync.Mutex
+	promotions map[string]*Promotion
+	path       string
+}
+
+// parsePromotions parses rules in the form `dev=>qa:2h` or `qa=>production:approval`
+func parsePromotions(values []string) ([]PromotionRule, error) {
+	var rules []PromotionRule
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		parts := strings.Split(value, ":")
+		envs := strings.Split(parts[0], "=>")
+		if len(envs) != 2 || strings.TrimSpace(envs[0]) == "" || strings.TrimSpace(envs[1]) == "" {
+			return nil, fmt.Errorf("Invalid promotion %s, expected from=>to", value)
+		}
+		rule := PromotionRule{From: strings.TrimSpace(envs[0]), To: strings.TrimSpace(envs[1])}
+		for _, option := range parts[1:] {
+			if option == promotionApproval {
+				rule.Approval = true
+				continue
+			}
+			soak, err := time.ParseDuration(option)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid soak period %s of promotion %s", option, value)
+			}
+			rule.Soak = soak
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func newPromotionStore() *PromotionStore {
+	return &PromotionStore{promotions: make(map[string]*Promotion)}
+}
+
+// openPromotions loads the promotions saved in the data directory. Without a data directory
+// they are kept in memory only.
+func openPromotions(dir string) (*PromotionStore, error) {
+	ps := newPromotionStore()
+	if dir == "" {
+		return ps, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ps.path = filepath.Join(dir, promotionsFile)
+	content, err := ioutil.ReadFile(ps.path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []StoredPromotion
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", ps.path, err)
+	}
+	for _, sp := range stored {
+		p := sp.Promotion
+		p.command, p.services = sp.Command, sp.Services
+		ps.promotions[p.ID] = p
+	}
+	return ps, nil
+}
+
+// save writes the promotions to the promotions file, replacing it atomically. It must be called with the lock held.
+func (ps *PromotionStore) save() error {
+	if ps.path == "" {
+		return nil
+	}
+	stored := make([]StoredPromotion, 0, len(ps.promotions))
+	for _, p := range ps.promotions {
+		stored = append(stored, StoredPromotion{Promotion: p, Command: p.command, Services: p.services})
+	}
+	sort.Slice(stored, func(i, k int) bool { return stored[i].Promotion.Created.Before(stored[k].Promotion.Created) })
+	content, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ps.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ps.path)
+}
+
+func (ps *PromotionStore) put(p *Promotion) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(ps.promotions) >= maxJobs {
+		var oldest *Promotion
+		for _, o := range ps.promotions {
+			if oldest == nil || o.Created.Before(oldest.Created) {
+				oldest = o
+			}
+		}
+		delete(ps.promotions, oldest.ID)
+	}
+	ps.promotions[p.ID] = p
+	return ps.save()
+}
+
+// changed saves the promotions after one of them was updated
+func (ps *PromotionStore) changed() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.save()
+}
+
+func (ps *PromotionStore) get(id string) *Promotion {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.promotions[id]
+}
+
+func (ps *PromotionStore) list() []*Promotion {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	promotions := make([]*Promotion, 0, len(ps.promotions))
+	for _, p := range ps.promotions {
+		promotions = append(promotions, p)
+	}
+	sort.Slice(promotions, func(i, k int) bool { return promotions[i].Created.After(promotions[k].Created) })
+	return promotions
+}
+
+// update applies a change to the promotion while holding its lock
+func (p *Promotion) update(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f()
+	p.Updated = time.Now().UTC()
+}
+
+// transition moves the promotion from one status to another, and reports whether it was in that status
+func (p *Promotion) transition(from string, to string) bool {
+	moved := false
+	p.update(func() {
+		if p.Status == from {
+			p.Status = to
+			moved = true
+		}
+	})
+	return moved
+}
+
+// MarshalJSON serializes the promotion while holding its lock
+func (p *Promotion) MarshalJSON() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	type promotion Promotion
+	return json.Marshal((*promotion)(p))
+}
+
+// promotionTarget reports whether the environment is the target of a promotion rule
+func (s *ServiceUpdater) promotionTarget(env string) bool {
+	for _, rule := range s.Config.Promotions {
+		if rule.To == env {
+			return true
+		}
+	}
+	return false
+}
+
+// environmentAllowed reports whether the command may upgrade services in the environment.
+// Commands without environments only upgrade environments that are not promoted to.
+func (s *ServiceUpdater) environmentAllowed(command UpdateCommand, env string) bool {
+	if len(command.Environments) == 0 {
+		return !s.promotionTarget(env)
+	}
+	for _, e := range command.Environments {
+		if e == env {
+			return true
+		}
+	}
+	return false
+}
+
+// runJob runs the upgrades of the job and starts the promotions of the environments it upgraded
+func (s *ServiceUpdater) runJob(job *Job, command UpdateCommand) {
+	span := s.tracer.start(s.span, "job", spanInternal, "job_id", job.ID, "trigger", job.Trigger)
+	defer span.finish(nil)
+	s = s.withSpan(span)
+	job.update(func() { job.TraceID = span.traceID() })
+	if len(command.Images) > 0 {
+		s.upgradeRelease(job, command)
+	} else {
+		s.upgradeService(job, command)
+	}
+	if !job.queued() {
+		s.complete(job, command)
+	}
+}
+
+// promote starts the promotions of every environment whose upgrades of the job were all finished
+func (s *ServiceUpdater) promote(job *Job, command UpdateCommand) {
+	if len(s.Config.Promotions) == 0 {
+		return
+	}
+	services := make(map[string][]string)
+	failed := make(map[string]bool)
+	job.update(func() {
+		for _, target := range job.Services {
+			if target.Status != ServiceSucceeded {
+				failed[target.Environment] = true
+				continue
+			}
+			services[target.Environment] = append(services[target.Environment], target.ServiceID)
+		}
+	})
+	name := job.name()
+	for env, ids := range services {
+		if failed[env] {
+			continue
+		}
+		for _, rule := range s.Config.Promotions {
+			if rule.From != env {
+				continue
+			}
+			now := time.Now().UTC()
+			promotionCommand := command
+			promotionCommand.Environments = []string{rule.To}
+			p := &Promotion{
+				ID:        newID(),
+				Name:      name,
+				From:      rule.From,
+				To:        rule.To,
+				Status:    PromotionSoaking,
+				SourceJob: job.ID,
+				Created:   now,
+				PromoteAt: now.Add(rule.Soak),
+				Updated:   now,
+				command:   promotionCommand,
+				services:  ids,
+			}
+			if err := s.promotions.put(p); err != nil {
+				s.log.errorf("Unable to save the promotion of %s to %s: %s", name, rule.To, err)
+			}
+			s.log.infof("Soaking %s in %s for %s before promoting to %s", name, rule.From, rule.Soak, rule.To)
+			go s.soak(p, rule)
+		}
+	}
+}
+
+// soak watches the health of the upgraded services until the soak period is over, then promotes
+// or waits for approval
+func (s *ServiceUpdater) soak(p *Promotion, rule PromotionRule) {
+	for {
+		if err := s.checkSoak(p.services); err != nil {
+			s.log.errorf("Promotion of %s to %s failed: %s", p.Name, p.To, err)
+			p.update(func() {
+				p.Status = PromotionFailed
+				p.Error = err.Error()
+			})
+			s.savePromotions()
+			s.slackMessage(s.log, "danger", fmt.Sprintf("`%s` was not promoted from %s to %s: %s", p.Name, p.From, p.To, err.Error()))
+			return
+		}
+		remaining := time.Until(p.PromoteAt)
+		if remaining <= 0 {
+			break
+		}
+		if remaining > promotionCheckInterval {
+			remaining = promotionCheckInterval
+		}
+		time.Sleep(remaining)
+	}
+	if rule.Approval {
+		if p.transition(PromotionSoaking, PromotionAwaitingApproval) {
+			s.savePromotions()
+			s.log.infof("Promotion of %s to %s awaits approval", p.Name, p.To)
+			s.slackMessage(s.log, "warning", fmt.Sprintf("`%s` is ready to be promoted from %s to %s and awaits approval: promotion `%s`", p.Name, p.From, p.To, p.ID))
+		}
+		return
+	}
+	if p.transition(PromotionSoaking, PromotionPromoted) {
+		s.startPromotion(p)
+	}
+}
+
+// resumePromotions starts soaking the promotions that were soaking before a restart again.
+// A promotion whose rule was removed in the meantime fails.
+func (s *ServiceUpdater) resumePromotions() {
+	for _, p := range s.promotions.list() {
+		p.mu.Lock()
+		soaking := p.Status == PromotionSoaking
+		p.mu.Unlock()
+		if !soaking {
+			continue
+		}
+		rule, ok := s.promotionRule(p.From, p.To)
+		if !ok {
+			s.log.warnf("Promotion of %s to %s is no longer configured", p.Name, p.To)
+			p.update(func() {
+				p.Status = PromotionFailed
+				p.Error = fmt.Sprintf("Promotion from %s to %s is no longer configured", p.From, p.To)
+			})
+			s.savePromotions()
+			continue
+		}
+		s.log.infof("Resuming to soak %s in %s before promoting to %s", p.Name, p.From, p.To)
+		go s.soak(p, rule)
+	}
+}
+
+func (s *ServiceUpdater) promotionRule(from string, to string) (PromotionRule, bool) {
+	for _, rule := range s.Config.Promotions {
+		if rule.From == from && rule.To == to {
+			return rule, true
+		}
+	}
+	return PromotionRule{}, false
+}
+
+// savePromotions saves the promotions after a change, logging failures as they happen in the background
+func (s *ServiceUpdater) savePromotions() {
+	if err := s.promotions.changed(); err != nil {
+		s.log.errorf("Unable to save promotions: %s", err)
+	}
+}
+
+// checkSoak fails if any of the upgraded services is no longer active and healthy
+func (s *ServiceUpdater) checkSoak(ids []string) error {
+	for _, id := range ids {
+		if entry := s.blueGreen.get(id); entry != nil {
+			id = entry.GreenID
+		}
+		svc, err := s.service.ById(id)
+		if err != nil {
+			return err
+		}
+		if svc == nil {
+			return fmt.Errorf("Service %s not found", id)
+		}
+		if svc.State != "active" || (svc.HealthState != "" && svc.HealthState != "healthy") {
+			return fmt.Errorf("Service %s not healthy: %s/%s", svc.Name, svc.State, svc.HealthState)
+		}
+	}
+	return nil
+}
+
+// startPromotion starts the job upgrading the next environment
+func (s *ServiceUpdater) startPromotion(p *Promotion) {
+	job := s.jobStore.create(p.command.Image)
+	job.update(func() {
+		job.Promotion = p.ID
+		job.Trigger = TriggerPromotion
+		job.Caller = fmt.Sprintf("promotion:%s=>%s", p.From, p.To)
+		job.Environments = p.command.Environments
+		if len(p.command.Images) > 0 {
+			job.Release = p.command.Release
+			job.Images = p.command.Images
+		}
+	})
+	p.update(func() { p.Job = job.ID })
+	s.savePromotions()
+	s.auditJob(job)
+	s.metrics.triggerReceived(TriggerPromotion, "accepted")
+	s.log.infof("Promoting %s from %s to %s", p.Name, p.From, p.To)
+	s.slackMessage(s.log, "good", fmt.Sprintf("Promoting `%s` from %s to %s", p.Name, p.From, p.To))
+	go s.runJob(job, p.command)
+}
+
+func (s *ServiceUpdater) promotionsHandler(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/promotions"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != "GET" {
+			utils.SendError(w, "Method not allowed", 405)
+			return
+		}
+		sendJSON(w, s.promotions.list(), 200)
+		return
+	}
+	p := s.promotions.get(parts[0])
+	if p == nil {
+		utils.SendError(w, "Promotion not found", 404)
+		return
+	}
+	if len(parts) == 1 && r.Method == "GET" {
+		sendJSON(w, p, 200)
+		return
+	}
+	if len(parts) != 2 || r.Method != "POST" {
+		utils.SendError(w, "Not found", 404)
+		return
+	}
+	if token := requestToken(r); token != nil {
+		if err := token.mayApprove([]string{p.To}); err != nil {
+			utils.SendError(w, err.Error(), 403)
+			return
+		}
+	}
+	var status string
+	switch parts[1] {
+	case "approve":
+		status = ApprovalApproved
+		if !p.transition(PromotionAwaitingApproval, PromotionPromoted) {
+			utils.SendError(w, "Promotion is not awaiting approval", 409)
+			return
+		}
+		s.startPromotion(p)
+	case "reject":
+		status = ApprovalRejected
+		if !p.transition(PromotionAwaitingApproval, PromotionRejected) {
+			utils.SendError(w, "Promotion is not awaiting approval", 409)
+			return
+		}
+		s.log.infof("Promotion of %s to %s was rejected", p.Name, p.To)
+		if err := s.promotions.changed(); err != nil {
+			utils.SendError(w, err.Error(), 500)
+			return
+		}
+	default:
+		utils.SendError(w, "Not found", 404)
+		return
+	}
+	s.audit.add(AuditApproval, caller(r), map[string]interface{}{"promotion": p.ID, "status": status, "to": p.To})
+	sendJSON(w, p, 200)
+}
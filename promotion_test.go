@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func Test_parsePromotions(t *testing.T) {
+	rules, err := parsePromotions([]string{"dev=>qa:2h", "qa=>production:approval", "production=>dr:30m:approval"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[0].From != "dev" || rules[0].To != "qa" || rules[0].Soak != 2*time.Hour || rules[0].Approval {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+	if !rules[1].Approval || rules[1].Soak != 0 || !rules[2].Approval || rules[2].Soak != 30*time.Minute {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+	for _, value := range []string{"dev", "dev=>", "dev=>qa:soon"} {
+		if _, err := parsePromotions([]string{value}); err == nil {
+			t.Errorf("expected %s to fail", value)
+		}
+	}
+}
+
+func newPromotionUpdater(rules ...PromotionRule) (*ServiceUpdater, *mockService) {
+	dev := testService(map[string]interface{}{})
+	qa := testService(map[string]interface{}{})
+	qa.Id, qa.AccountId = "1s2", "1a2"
+	updater, service := newTestUpdater(dev, qa)
+	updater.account = &mockAccount{accounts: []client.Account{
+		{Resource: client.Resource{Id: "1a1"}, Name: "dev"},
+		{Resource: client.Resource{Id: "1a2"}, Name: "qa"},
+	}}
+	updater.Config.Promotions = rules
+	return updater, service
+}
+
+func waitForPromotion(t *testing.T, updater *ServiceUpdater, status string) *Promotion {
+	for i := 0; i < 100; i++ {
+		for _, p := range updater.promotions.list() {
+			p.mu.Lock()
+			current := p.Status
+			p.mu.Unlock()
+			if current == status {
+				return p
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no promotion reached %s", status)
+	return nil
+}
+
+func waitForJob(t *testing.T, job *Job) {
+	for i := 0; i < 100; i++ {
+		job.mu.Lock()
+		status := job.Status
+		job.mu.Unlock()
+		if status != JobRunning && status != JobAwaitingApproval {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", job.ID)
+}
+
+func Test_promote(t *testing.T) {
+	promotionCheckInterval = 5 * time.Millisecond
+	updater, service := newPromotionUpdater(PromotionRule{From: "dev", To: "qa", Soak: 20 * time.Millisecond})
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if len(job.Services) != 1 || job.Services[0].Environment != "dev" {
+		t.Fatalf("expected the trigger to only upgrade dev, got %+v", job.Services)
+	}
+	p := waitForPromotion(t, updater, PromotionPromoted)
+	promoted := updater.jobStore.get(p.Job)
+	waitForJob(t, promoted)
+	if promoted.Status != JobSucceeded || len(promoted.Services) != 1 || promoted.Services[0].Environment != "qa" {
+		t.Fatalf("expected promotion to upgrade qa, got %+v", promoted)
+	}
+	if len(service.finished) != 2 {
+		t.Errorf("expected both upgrades to be finished, got %v", service.finished)
+	}
+}
+
+func Test_promoteApproval(t *testing.T) {
+	promotionCheckInterval = 5 * time.Millisecond
+	updater, service := newPromotionUpdater(PromotionRule{From: "dev", To: "qa", Approval: true})
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	p := waitForPromotion(t, updater, PromotionAwaitingApproval)
+	if p.Job != "" || len(service.finished) != 1 {
+		t.Fatalf("expected promotion to wait for approval, got %+v", p)
+	}
+	if !p.transition(PromotionAwaitingApproval, PromotionRejected) {
+		t.Error("expected promotion to be rejected")
+	}
+	if p.transition(PromotionAwaitingApproval, PromotionPromoted) {
+		t.Error("expected rejected promotion not to be approved")
+	}
+}
+
+func Test_promoteUnhealthy(t *testing.T) {
+	promotionCheckInterval = 5 * time.Millisecond
+	updater, service := newPromotionUpdater(PromotionRule{From: "dev", To: "qa", Soak: time.Second})
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	waitForPromotion(t, updater, PromotionSoaking)
+
+	service.setState("1s1", "degraded")
+	p := waitForPromotion(t, updater, PromotionFailed)
+	if p.Job != "" || len(service.finished) != 1 {
+		t.Errorf("expected unhealthy service not to be promoted, got %+v", p)
+	}
+}
+
+func Test_promotionsPersisted(t *testing.T) {
+	promotionCheckInterval = 5 * time.Millisecond
+	dir, _ := ioutil.TempDir("", "promotions")
+	defer os.RemoveAll(dir)
+	store, err := openPromotions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	store.put(&Promotion{ID: "p1", Name: "myorg/api:2.0", From: "dev", To: "qa", Status: PromotionSoaking, Created: now, PromoteAt: now,
+		command: UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1, Environments: []string{"qa"}}, services: []string{"1s1"}})
+
+	restarted, service := newPromotionUpdater(PromotionRule{From: "dev", To: "qa"})
+	service.setState("1s1", "active")
+	if restarted.promotions, err = openPromotions(dir); err != nil {
+		t.Fatal(err)
+	}
+	restarted.resumePromotions()
+	p := waitForPromotion(t, restarted, PromotionPromoted)
+	promoted := restarted.jobStore.get(p.Job)
+	waitForJob(t, promoted)
+	if promoted.Status != JobSucceeded || len(promoted.Services) != 1 || promoted.Services[0].Environment != "qa" {
+		t.Fatalf("expected the restored promotion to upgrade qa, got %+v", promoted)
+	}
+	if reopened, _ := openPromotions(dir); reopened.get("p1").Status != PromotionPromoted || reopened.get("p1").Job != p.Job {
+		t.Errorf("expected the promotion to be saved, got %+v", reopened.get("p1"))
+	}
+}
+
+func Test_promotionApprovalScoped(t *testing.T) {
+	updater, _ := newPromotionUpdater(PromotionRule{From: "dev", To: "qa", Approval: true})
+	updater.Config.APITokens = []APIToken{{Name: "dev", Token: "t0ken", Scopes: []string{ScopeApprove}, Environments: "^dev$"}}
+	updater.promotions.put(&Promotion{ID: "p1", From: "dev", To: "qa", Status: PromotionAwaitingApproval})
+
+	handler := updater.authorize(ScopeRead, ScopeApprove, updater.promotionsHandler)
+	req := httptest.NewRequest("POST", "/promotions/p1/approve", nil)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != 403 || updater.promotions.get("p1").Status != PromotionAwaitingApproval {
+		t.Errorf("expected the approval outside the token scope to be denied, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/go-rancher/client"
+)
+
+// The instrumented clients record the latency and errors of every Rancher API call by operation,
+// and trace the calls as children of their span if they have one
+
+// instrumentation records Rancher API calls in the metrics and as spans
+type instrumentation struct {
+	metrics *Metrics
+	span    *Span
+}
+
+type instrumentedService struct {
+	Service
+	instrumentation
+}
+
+type instrumentedAccount struct {
+	Account
+	instrumentation
+}
+
+type instrumentedStack struct {
+	Stack
+	instrumentation
+}
+
+type instrumentedContainer struct {
+	Container
+	instrumentation
+}
+
+type instrumentedBase struct {
+	RancherBase
+	instrumentation
+}
+
+// timed runs a Rancher API call and records it as the operation
+func (in instrumentation) timed(operation string, call func() error) {
+	span := in.span.child("rancher "+operation, spanClient, "rancher.operation", operation)
+	start := time.Now()
+	err := call()
+	in.metrics.rancherCall(operation, time.Since(start), err)
+	span.finish(err)
+}
+
+// timed records a Rancher API call that is not made through one of the clients, e.g. paging a collection
+func (s *ServiceUpdater) timed(operation string, call func() error) {
+	instrumentation{s.metrics, s.span}.timed(operation, call)
+}
+
+func (i instrumentedService) ById(id string) (svc *client.Service, err error) {
+	i.timed("service.get", func() error { svc, err = i.Service.ById(id); return err })
+	return
+}
+
+func (i instrumentedService) List(opts *client.ListOpts) (services *client.ServiceCollection, err error) {
+	i.timed("service.list", func() error { services, err = i.Service.List(opts); return err })
+	return
+}
+
+func (i instrumentedService) Create(opts *client.Service) (svc *client.Service, err error) {
+	i.timed("service.create", func() error { svc, err = i.Service.Create(opts); return err })
+	return
+}
+
+func (i instrumentedService) ActionActivate(s *client.Service) (svc *client.Service, err error) {
+	i.timed("service.activate", func() error { svc, err = i.Service.ActionActivate(s); return err })
+	return
+}
+
+func (i instrumentedService) ActionDeactivate(s *client.Service) (svc *client.Service, err error) {
+	i.timed("service.deactivate", func() error { svc, err = i.Service.ActionDeactivate(s); return err })
+	return
+}
+
+func (i instrumentedService) ActionRemove(s *client.Service) (svc *client.Service, err error) {
+	i.timed("service.remove", func() error { svc, err = i.Service.ActionRemove(s); return err })
+	return
+}
+
+func (i instrumentedService) ActionCancelupgrade(s *client.Service) (svc *client.Service, err error) {
+	i.timed("service.cancelupgrade", func() error { svc, err = i.Service.ActionCancelupgrade(s); return err })
+	return
+}
+
+func (i instrumentedService) ActionFinishupgrade(s *client.Service) (svc *client.Service, err error) {
+	i.timed("service.finishupgrade", func() error { svc, err = i.Service.ActionFinishupgrade(s); return err })
+	return
+}
+
+func (i instrumentedService) ActionRollback(s *client.Service) (svc *client.Service, err error) {
+	i.timed("service.rollback", func() error { svc, err = i.Service.ActionRollback(s); return err })
+	return
+}
+
+func (i instrumentedService) ActionUpgrade(s *client.Service, upgrade *client.ServiceUpgrade) (svc *client.Service, err error) {
+	i.timed("service.upgrade", func() error { svc, err = i.Service.ActionUpgrade(s, upgrade); return err })
+	return
+}
+
+func (i instrumentedAccount) List(opts *client.ListOpts) (accounts *client.AccountCollection, err error) {
+	i.timed("account.list", func() error { accounts, err = i.Account.List(opts); return err })
+	return
+}
+
+func (i instrumentedStack) ById(id string) (stack *client.Environment, err error) {
+	i.timed("stack.get", func() error { stack, err = i.Stack.ById(id); return err })
+	return
+}
+
+func (i instrumentedStack) ActionExportconfig(s *client.Environment, input *client.ComposeConfigInput) (config *client.ComposeConfig, err error) {
+	i.timed("stack.exportconfig", func() error { config, err = i.Stack.ActionExportconfig(s, input); return err })
+	return
+}
+
+func (i instrumentedStack) ActionFinishupgrade(s *client.Environment) (stack *client.Environment, err error) {
+	i.timed("stack.finishupgrade", func() error { stack, err = i.Stack.ActionFinishupgrade(s); return err })
+	return
+}
+
+func (i instrumentedStack) ActionRollback(s *client.Environment) (stack *client.Environment, err error) {
+	i.timed("stack.rollback", func() error { stack, err = i.Stack.ActionRollback(s); return err })
+	return
+}
+
+func (i instrumentedStack) ActionUpgrade(s *client.Environment, upgrade *client.EnvironmentUpgrade) (stack *client.Environment, err error) {
+	i.timed("stack.upgrade", func() error { stack, err = i.Stack.ActionUpgrade(s, upgrade); return err })
+	return
+}
+
+func (i instrumentedContainer) ActionExecute(c *client.Container, exec *client.ContainerExec) (access *client.HostAccess, err error) {
+	i.timed("container.execute", func() error { access, err = i.Container.ActionExecute(c, exec); return err })
+	return
+}
+
+func (i instrumentedBase) GetLink(resource client.Resource, link string, respObject interface{}) (err error) {
+	i.timed("link."+link, func() error { err = i.RancherBase.GetLink(resource, link, respObject); return err })
+	return
+}
+
+func (i instrumentedBase) Websocket(url string, headers map[string][]string) (conn *websocket.Conn, resp *http.Response, err error) {
+	i.timed("websocket", func() error { conn, resp, err = i.RancherBase.Websocket(url, headers); return err })
+	return
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// releaseStep is one service of a release together with its job entry
+type releaseStep struct {
+	command   UpdateCommand
+	candidate Candidate
+	event     HookEvent
+	target    *JobService
+	started   bool
+	finished  bool
+}
+
+// planRelease finds the candidates of every image of the release, in order
+func (s *ServiceUpdater) planRelease(job *Job, command UpdateCommand) ([]*releaseStep, error) {
+	var steps []*releaseStep
+	for _, image := range command.Images {
+		imageCommand := command
+		imageCommand.Image = image
+		if !strings.HasPrefix(imageCommand.Image, "docker:") {
+			imageCommand.Image = fmt.Sprintf("docker:%s", imageCommand.Image)
+		}
+		candidates, err := s.findCandidates(job, imageCommand)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range candidates {
+			strategy := strategyFor(imageCommand, c.Service)
+			if strategy != StrategyRolling && strategy != StrategyCanary {
+				return nil, fmt.Errorf("Service %s uses the %s strategy, releases only support rolling and canary upgrades", c.Service.Name, strategy)
+			}
+			event := c.event(imageCommand)
+			steps = append(steps, &releaseStep{
+				command:   imageCommand,
+				candidate: c,
+				event:     event,
+				target: &JobService{
+					ServiceID:     c.Service.Id,
+					Service:       c.Service.Name,
+					Environment:   c.Environment,
+					StackID:       c.Service.EnvironmentId,
+					FromImage:     event.FromImage,
+					ToImage:       event.ToImage,
+					LaunchConfigs: c.launchConfigs(),
+					Strategy:      strategy,
+					Status:        ServicePending,
+				},
+			})
+		}
+	}
+	for _, step := range steps {
+		job.add(step.target)
+	}
+	return steps, nil
+}
+
+// upgradeRelease upgrades the services of all images of the release in order. Upgrades are
+// only finished once every service is upgraded and verified. If any service fails, the
+// services already upgraded are rolled back.
+func (s *ServiceUpdater) upgradeRelease(job *Job, command UpdateCommand) {
+	defer job.finish()
+	steps, err := s.planRelease(job, command)
+	if err != nil {
+		s.jobLog(job).errorf("Unable to plan release %s: %s", job.Release, err)
+		job.update(func() { job.Error = err.Error() })
+		s.slackMessage(s.jobLog(job), "danger", fmt.Sprintf("Release `%s` was not started: %s", job.Release, err.Error()))
+		return
+	}
+	candidates := make([]Candidate, len(steps))
+	targets := make([]*JobService, len(steps))
+	for i, step := range steps {
+		candidates[i], targets[i] = step.candidate, step.target
+	}
+	if err := s.requireApproval(job, candidates); err != nil {
+		job.update(func() {
+			job.Error = err.Error()
+			for _, target := range targets {
+				target.Status = ServiceAborted
+				target.Error = err.Error()
+			}
+		})
+		return
+	}
+	job.mu.Lock()
+	approved := job.Approval != nil
+	job.mu.Unlock()
+	if approved {
+		steps = s.recheckSteps(job, steps)
+		candidates, targets = candidates[:0], targets[:0]
+		for _, step := range steps {
+			candidates, targets = append(candidates, step.candidate), append(targets, step.target)
+		}
+	}
+	queued := func() { s.runRelease(job, command, s.recheckSteps(job, steps)) }
+	if len(steps) == 0 || !s.schedule(job, command, candidates, targets, queued) {
+		s.runRelease(job, command, steps)
+	}
+}
+
+// recheckSteps refreshes the candidates of the release, dropping the services that would no
+// longer be upgraded
+func (s *ServiceUpdater) recheckSteps(job *Job, steps []*releaseStep) []*releaseStep {
+	var current []*releaseStep
+	for _, step := range steps {
+		if c, ok := s.recheck(job, step.target, step.command, step.candidate); ok {
+			step.candidate, step.event = c, c.event(step.command)
+			current = append(current, step)
+		}
+	}
+	return current
+}
+
+// runRelease stages every service of the release and finishes them once all are staged
+func (s *ServiceUpdater) runRelease(job *Job, command UpdateCommand, steps []*releaseStep) {
+	for _, step := range steps {
+		if err := s.stageRelease(job, step); err != nil {
+			s.failRelease(job, steps, step, err)
+			return
+		}
+	}
+
+	if command.Confirm {
+		for _, step := range steps {
+			if err := s.runHooks(HookPreFinish, step.event); err != nil {
+				s.failRelease(job, steps, step, err)
+				return
+			}
+		}
+		for _, step := range steps {
+			current, err := s.serviceByID(step.candidate.Service.Id)
+			if err == nil {
+				_, err = s.service.ActionFinishupgrade(current)
+			}
+			if err != nil {
+				s.jobLog(job).forEvent(step.event).errorf("Unable to finish upgrade of %s: %s", step.candidate.Service.Name, err)
+				s.failRelease(job, steps, step, err)
+				return
+			}
+			step.finished = true
+			job.update(func() {
+				step.target.Status = ServiceSucceeded
+				step.target.Stage = ""
+			})
+		}
+	}
+
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = fmt.Sprintf("%s (%s)", step.candidate.Service.Name, step.candidate.Environment)
+		s.runHooks(HookPostUpgrade, step.event)
+	}
+	s.jobLog(job).infof("Upgraded release %s", job.Release)
+	if len(steps) > 0 {
+		s.slackMessage(s.jobLog(job), "good", fmt.Sprintf("Release `%s` has been successfully upgraded to `%s`: %s",
+			job.Release, strings.Join(command.Images, "`, `"), strings.Join(names, ", ")))
+	}
+}
+
+// stageRelease upgrades one service of a release up to the point where it could be finished
+func (s *ServiceUpdater) stageRelease(job *Job, step *releaseStep) error {
+	svc := step.candidate.Service
+	job.update(func() { step.target.Status = ServiceUpgrading })
+	if err := s.runHooks(HookPreUpgrade, step.event); err != nil {
+		return err
+	}
+	s.jobLog(job).forEvent(step.event).infof("Upgrading %s in release %s", svc.Name, job.Release)
+	s.metrics.upgradeStarted(targetTags(step.target))
+	if err := s.doUpgrade(s.jobLog(job).forEvent(step.event), step.command, step.candidate); err != nil {
+		return err
+	}
+	step.started = true
+	svc.LaunchConfig = step.candidate.launchConfig(step.command.Image)
+	command := step.command
+	if step.target.Strategy == StrategyCanary {
+		job.update(func() { step.target.Stage = StageCanary })
+		if err := s.runCanary(job, step.target, command, step.candidate); err != nil {
+			return err
+		}
+	}
+	if _, err := s.awaitUpgraded(command, svc); err != nil {
+		return err
+	}
+	job.update(func() { step.target.Status = ServiceUpgraded })
+	return nil
+}
+
+// failRelease rolls back every service of the release that was already started. Services
+// that were already finished cannot be rolled back anymore and are kept.
+func (s *ServiceUpdater) failRelease(job *Job, steps []*releaseStep, failed *releaseStep, cause error) {
+	s.jobLog(job).warnf("Release %s failed at %s: %s", job.Release, failed.candidate.Service.Name, cause)
+	var rolledBack, finished []string
+	for _, step := range steps {
+		if step.finished {
+			finished = append(finished, step.candidate.Service.Name)
+			continue
+		}
+		step.event.Error = cause.Error()
+		if !step.started {
+			job.update(func() {
+				if step == failed {
+					step.target.Status = ServiceFailed
+					step.target.Error = cause.Error()
+				} else {
+					step.target.Status = ServiceAborted
+					step.target.Error = fmt.Sprintf("Release failed at %s", failed.candidate.Service.Name)
+				}
+			})
+			s.runHooks(HookOnFailure, step.event)
+			continue
+		}
+		var err error
+		if step.target.Stage != StageRolledBack {
+			err = s.rollbackUpgrade(step.candidate.Service)
+			s.auditRollback("updater", map[string]interface{}{
+				"service": step.target.Service, "service_id": step.target.ServiceID, "environment": step.target.Environment, "reason": "release failed",
+			}, err)
+		}
+		job.update(func() {
+			if err != nil {
+				step.target.Status = ServiceFailed
+				step.target.Error = fmt.Sprintf("Rollback failed: %s", err)
+			} else {
+				step.target.Status = ServiceRolledBack
+				step.target.Error = cause.Error()
+				if step != failed {
+					step.target.Error = fmt.Sprintf("Release failed at %s", failed.candidate.Service.Name)
+				}
+			}
+		})
+		if err == nil {
+			rolledBack = append(rolledBack, step.candidate.Service.Name)
+		}
+		s.runHooks(HookOnFailure, step.event)
+	}
+	message := fmt.Sprintf("Release `%s` failed at `%s`: %s", job.Release, failed.candidate.Service.Name, cause.Error())
+	if len(rolledBack) > 0 {
+		message += fmt.Sprintf("\nRolled back: %s", strings.Join(rolledBack, ", "))
+	}
+	if len(finished) > 0 {
+		message += fmt.Sprintf("\nAlready finished: %s", strings.Join(finished, ", "))
+	}
+	s.slackMessage(s.jobLog(job), "danger", message)
+}
+
+// awaitUpgraded waits for the service to reach the upgraded state and verifies it
+func (s *ServiceUpdater) awaitUpgraded(command UpdateCommand, service client.Service) (*client.Service, error) {
+	upgraded, err := s.waitForState(service.Id, "upgraded", time.Duration(command.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyService(*upgraded, command.Image); err != nil {
+		return nil, err
+	}
+	return upgraded, nil
+}
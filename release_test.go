@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func Test_upgradeRelease(t *testing.T) {
+	api := testService(map[string]interface{}{})
+	web := testService(map[string]interface{}{})
+	web.Id, web.Name = "1s2", "web"
+	web.LaunchConfig = &client.LaunchConfig{ImageUuid: "docker:myorg/web:1.0", Labels: map[string]interface{}{"autoupdate.enable": "true"}}
+	updater, service := newTestUpdater(api, web)
+
+	job := updater.jobStore.create("")
+	job.Release = "r1"
+	updater.upgradeRelease(job, UpdateCommand{Images: []string{"myorg/api:2.0", "myorg/web:2.0"}, Confirm: true, Timeout: 1})
+
+	if job.Status != JobSucceeded || len(job.Services) != 2 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if job.Services[0].Service != "api" || job.Services[1].Service != "web" {
+		t.Errorf("expected services to be upgraded in image order")
+	}
+	if len(service.finished) != 2 {
+		t.Errorf("expected both upgrades to be finished, got %v", service.finished)
+	}
+}
+
+func Test_upgradeReleaseRollback(t *testing.T) {
+	api := testService(map[string]interface{}{})
+	web := testService(map[string]interface{}{})
+	web.Id, web.Name = "1s2", "web"
+	web.LaunchConfig = &client.LaunchConfig{ImageUuid: "docker:myorg/web:1.0", Labels: map[string]interface{}{"autoupdate.enable": "true"}}
+	updater, service := newTestUpdater(api, web)
+	service.states["1s2"] = "upgrading"
+
+	job := updater.jobStore.create("")
+	updater.upgradeRelease(job, UpdateCommand{Images: []string{"myorg/api:2.0", "myorg/web:2.0"}, Confirm: true, Timeout: 1})
+
+	if job.Status != JobFailed {
+		t.Fatalf("expected release to fail, got %s", job.Status)
+	}
+	for _, target := range job.Services {
+		if target.Status != ServiceRolledBack {
+			t.Errorf("expected %s to be rolled back, got %s", target.Service, target.Status)
+		}
+	}
+	if len(service.finished) != 0 || len(service.rolledBack) != 2 {
+		t.Errorf("expected no finished and 2 rolled back upgrades, got %v %v", service.finished, service.rolledBack)
+	}
+}
+
+func Test_upgradeReleaseFinishFails(t *testing.T) {
+	api := testService(map[string]interface{}{})
+	web := testService(map[string]interface{}{})
+	web.Id, web.Name = "1s2", "web"
+	web.LaunchConfig = &client.LaunchConfig{ImageUuid: "docker:myorg/web:1.0", Labels: map[string]interface{}{"autoupdate.enable": "true"}}
+	updater, service := newTestUpdater(api, web)
+	service.finishErr = map[string]error{"1s2": fmt.Errorf("finish failed")}
+	var posted []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event HookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, event.Service)
+	}))
+	defer server.Close()
+	updater.Config.Hooks = map[string][]string{HookPostUpgrade: {server.URL}}
+
+	job := updater.jobStore.create("")
+	updater.upgradeRelease(job, UpdateCommand{Images: []string{"myorg/api:2.0", "myorg/web:2.0"}, Confirm: true, Timeout: 1})
+
+	if job.Status != JobFailed {
+		t.Fatalf("expected release to fail, got %s", job.Status)
+	}
+	if job.Services[0].Status != ServiceSucceeded || job.Services[1].Status != ServiceRolledBack {
+		t.Errorf("expected api to be kept and web to be rolled back, got %s %s", job.Services[0].Status, job.Services[1].Status)
+	}
+	if len(service.rolledBack) != 1 || service.rolledBack[0] != "1s2" {
+		t.Errorf("expected only the unfinished upgrade to be rolled back, got %v", service.rolledBack)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 0 {
+		t.Errorf("expected no post_upgrade hooks, got %v", posted)
+	}
+}
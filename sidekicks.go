@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// PrimaryLaunchConfig is the name reported for the primary launch config of a service
+const PrimaryLaunchConfig = "primary"
+
+// splitImage splits an image uuid into the image and the version
+func splitImage(imageUUID string) (string, string) {
+	idx := strings.LastIndex(imageUUID, ":")
+	if idx < 1 {
+		return imageUUID, ""
+	}
+	return imageUUID[0 : idx-1], imageUUID[idx:]
+}
+
+func newer(foundVer, wantedVer string) bool {
+	return (foundVer < wantedVer) || (wantedVer == "latest")
+}
+
+func enabled(labels map[string]interface{}, enableLabel string) bool {
+	enable, ok := labels[enableLabel]
+	return ok && enable != "false"
+}
+
+// sidekick returns the name, image and labels of a secondary launch config
+func sidekick(config interface{}) (string, string, map[string]interface{}) {
+	values, ok := config.(map[string]interface{})
+	if !ok {
+		return "", "", nil
+	}
+	name, _ := values["name"].(string)
+	image, _ := values["imageUuid"].(string)
+	labels, _ := values["labels"].(map[string]interface{})
+	return name, image, labels
+}
+
+// matchSidekicks returns the names and current image of the enabled sidekicks of the service
+// that run an older version of the wanted image
+func matchSidekicks(service client.Service, enableLabel string, wantedImage string, wantedVer string) ([]string, string) {
+	var names []string
+	var from string
+	for _, config := range service.SecondaryLaunchConfigs {
+		name, image, labels := sidekick(config)
+		if name == "" || !enabled(labels, enableLabel) {
+			continue
+		}
+		foundImage, foundVer := splitImage(image)
+		if foundImage == wantedImage && newer(foundVer, wantedVer) {
+			names = append(names, name)
+			if from == "" {
+				from = image
+			}
+		}
+	}
+	return names, from
+}
+
+// fromImages returns the current images of the launch configs the candidate upgrades
+func (c Candidate) fromImages() []string {
+	var images []string
+	if c.Primary {
+		images = append(images, c.Service.LaunchConfig.ImageUuid)
+	}
+	for _, config := range c.Service.SecondaryLaunchConfigs {
+		name, image, _ := sidekick(config)
+		for _, n := range c.Sidekicks {
+			if n == name {
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
+
+// upgradedSidekicks returns a copy of the secondary launch configs with the image of the named sidekicks replaced
+func upgradedSidekicks(configs []interface{}, names []string, image string) []interface{} {
+	upgraded := make([]interface{}, len(configs))
+	for i, config := range configs {
+		upgraded[i] = config
+		name, _, _ := sidekick(config)
+		for _, n := range names {
+			if n != name {
+				continue
+			}
+			values := make(map[string]interface{})
+			for k, v := range config.(map[string]interface{}) {
+				values[k] = v
+			}
+			values["imageUuid"] = image
+			upgraded[i] = values
+		}
+	}
+	return upgraded
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_upgradeSidekick(t *testing.T) {
+	svc := testService(map[string]interface{}{})
+	delete(svc.LaunchConfig.Labels, "autoupdate.enable")
+	svc.LaunchConfig.ImageUuid = "docker:myorg/app:1.0"
+	svc.SecondaryLaunchConfigs = []interface{}{
+		map[string]interface{}{"name": "nginx", "imageUuid": "docker:myorg/nginx:1.0", "labels": map[string]interface{}{"autoupdate.enable": "true"}},
+		map[string]interface{}{"name": "logs", "imageUuid": "docker:myorg/nginx:1.0"},
+	}
+	updater, service := newTestUpdater(svc)
+
+	job := updater.jobStore.create("myorg/nginx:1.1")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/nginx:1.1", Timeout: 1})
+
+	if len(job.Services) != 1 || !reflect.DeepEqual(job.Services[0].LaunchConfigs, []string{"nginx"}) {
+		t.Fatalf("expected only the nginx sidekick to be reported, got %+v", job.Services)
+	}
+	if job.Services[0].FromImage != "docker:myorg/nginx:1.0" {
+		t.Errorf("unexpected from image %s", job.Services[0].FromImage)
+	}
+	strategy := service.upgrades[0].InServiceStrategy
+	if strategy.LaunchConfig.ImageUuid != "docker:myorg/app:1.0" {
+		t.Errorf("expected primary launch config to be untouched, got %s", strategy.LaunchConfig.ImageUuid)
+	}
+	if _, image, _ := sidekick(strategy.SecondaryLaunchConfigs[0]); image != "docker:myorg/nginx:1.1" {
+		t.Errorf("expected enabled sidekick to be upgraded, got %s", image)
+	}
+	if _, image, _ := sidekick(strategy.SecondaryLaunchConfigs[1]); image != "docker:myorg/nginx:1.0" {
+		t.Errorf("expected sidekick without enable label to be untouched, got %s", image)
+	}
+	if _, image, _ := sidekick(svc.SecondaryLaunchConfigs[0]); image != "docker:myorg/nginx:1.0" {
+		t.Errorf("expected service launch configs not to be modified")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const slackSignatureMaxAge = 5 * time.Minute
+
+var slackAPIURL = "https://slack.com/api"
+
+// slackResponse is the common part of the Slack Web API responses
+type slackResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// slackAction is the part of a block_actions interaction payload the updater uses
+type slackAction struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Name     string `json:"name"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// verifySlackSignature checks the X-Slack-Signature of a request body against the signing secret
+func verifySlackSignature(secret string, r *http.Request, body []byte) error {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid Slack request timestamp")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return fmt.Errorf("Slack request timestamp too old")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("Invalid Slack signature")
+	}
+	return nil
+}
+
+// readSlackRequest reads and verifies the body of a request sent by Slack
+func (s *ServiceUpdater) readSlackRequest(w http.ResponseWriter, r *http.Request) (url.Values, bool) {
+	if s.Config.SlackSigningSecret == "" {
+		utils.SendError(w, "Slack is not configured", 404)
+		return nil, false
+	}
+	if r.Method != "POST" {
+		utils.SendError(w, "Method not allowed", 405)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		utils.SendError(w, err.Error(), 400)
+		return nil, false
+	}
+	if err := verifySlackSignature(s.Config.SlackSigningSecret, r, body); err != nil {
+		s.log.warnf("Rejected Slack request: %s", err)
+		s.audit.add(AuditAuthFailure, caller(r), map[string]interface{}{"method": r.Method, "path": r.URL.Path, "reason": err.Error()})
+		utils.SendError(w, err.Error(), 401)
+		return nil, false
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		utils.SendError(w, err.Error(), 400)
+		return nil, false
+	}
+	return values, true
+}
+
+// slackCall calls a method of the Slack Web API with the bot token
+func (s *ServiceUpdater) slackCall(method string, payload interface{}) (response *slackResponse, err error) {
+	span := s.span.child("slack "+method, spanClient, "slack.method", method)
+	defer func() { span.finish(err) }()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", slackAPIURL, method), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.Config.SlackBotToken)
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result slackResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Invalid response from Slack %s: %s", method, err)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("Slack %s failed: %s", method, result.Error)
+	}
+	return &result, nil
+}
+
+func slackSection(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "section",
+		"text": map[string]string{"type": "mrkdwn", "text": text},
+	}
+}
+
+func slackButton(text string, style string, action string, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "button",
+		"text":      map[string]string{"type": "plain_text", "text": text},
+		"style":     style,
+		"action_id": action,
+		"value":     value,
+	}
+}
+
+// approvalText describes the job awaiting approval
+func approvalText(job *Job, approval *Approval) string {
+	return fmt.Sprintf("Job `%s` upgrading `%s` awaits approval until %s:\n%s", job.ID, job.name(),
+		approval.Expires.Format(time.RFC3339), strings.Join(approval.Services, "\n"))
+}
+
+// requestApproval notifies the approvers, with Approve/Reject buttons when a Slack bot token is configured
+func (s *ServiceUpdater) requestApproval(job *Job, approval *Approval) {
+	text := approvalText(job, approval)
+	if s.Config.SlackBotToken == "" {
+		s.slackMessage(s.jobLog(job), "warning", text)
+		return
+	}
+	result, err := s.slackCall("chat.postMessage", map[string]interface{}{
+		"channel":  s.Config.SlackChannel,
+		"username": s.Config.SlackBotName,
+		"text":     text,
+		"blocks": []interface{}{
+			slackSection(text),
+			map[string]interface{}{
+				"type":     "actions",
+				"block_id": "approval",
+				"elements": []interface{}{
+					slackButton("Approve", "primary", "approve", job.ID),
+					slackButton("Reject", "danger", "reject", job.ID),
+				},
+			},
+		},
+	})
+	if err != nil {
+		s.jobLog(job).errorf("Unable to send approval request: %s", err)
+		return
+	}
+	job.update(func() {
+		approval.slackChannel = result.Channel
+		approval.slackTS = result.TS
+	})
+}
+
+// resolveApproval replaces the buttons of the approval request with the decision
+func (s *ServiceUpdater) resolveApproval(job *Job, approval *Approval) {
+	var channel, ts, decision string
+	job.update(func() {
+		channel, ts = approval.slackChannel, approval.slackTS
+		decision = fmt.Sprintf("*%s*", approval.Status)
+		if approval.DecidedBy != "" {
+			decision = fmt.Sprintf("%s by %s", decision, approval.DecidedBy)
+		}
+		if approval.Reason != "" {
+			decision = fmt.Sprintf("%s: %s", decision, approval.Reason)
+		}
+	})
+	if ts == "" {
+		return
+	}
+	text := approvalText(job, approval)
+	_, err := s.slackCall("chat.update", map[string]interface{}{
+		"channel": channel,
+		"ts":      ts,
+		"text":    text,
+		"blocks":  []interface{}{slackSection(text), slackSection(decision)},
+	})
+	if err != nil {
+		s.jobLog(job).errorf("Unable to update approval request: %s", err)
+	}
+}
+
+// slackReply sends a message through the response URL of an interaction or command.
+// Ephemeral messages are only shown to the user.
+func (s *ServiceUpdater) slackReply(responseURL string, responseType string, text string) {
+	if responseURL == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"response_type":    responseType,
+		"replace_original": false,
+		"text":             text,
+	})
+	span := s.span.child("slack reply", spanClient, "slack.response_type", responseType)
+	resp, err := hookClient.Post(responseURL, "application/json", bytes.NewReader(body))
+	span.finish(err)
+	if err != nil {
+		s.log.errorf("Unable to reply to Slack: %s", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// slackActions handles the Approve/Reject buttons of approval requests
+func (s *ServiceUpdater) slackActions(w http.ResponseWriter, r *http.Request) {
+	s = s.traced(r)
+	values, ok := s.readSlackRequest(w, r)
+	if !ok {
+		return
+	}
+	var payload slackAction
+	if err := json.Unmarshal([]byte(values.Get("payload")), &payload); err != nil {
+		utils.SendError(w, err.Error(), 400)
+		return
+	}
+	w.WriteHeader(200)
+	if payload.Type != "block_actions" {
+		return
+	}
+	by := payload.User.Username
+	if by == "" {
+		by = payload.User.Name
+	}
+	by = fmt.Sprintf("slack:%s", by)
+	token, err := s.slackToken(payload.User.ID, payload.Channel.ID, ScopeApprove)
+	if err != nil {
+		s.audit.add(AuditAuthFailure, by, map[string]interface{}{"path": r.URL.Path, "reason": err.Error()})
+		s.slackReply(payload.ResponseURL, "ephemeral", err.Error())
+		return
+	}
+	for _, action := range payload.Actions {
+		status := ApprovalApproved
+		if action.ActionID == "reject" {
+			status = ApprovalRejected
+		} else if action.ActionID != "approve" {
+			continue
+		}
+		job := s.jobStore.get(action.Value)
+		if job == nil {
+			s.slackReply(payload.ResponseURL, "ephemeral", fmt.Sprintf("Job `%s` not found", action.Value))
+			continue
+		}
+		if token != nil {
+			if err := token.mayApprove(job.approvalEnvironments()); err != nil {
+				s.slackReply(payload.ResponseURL, "ephemeral", err.Error())
+				continue
+			}
+		}
+		if err := job.decide(status, by, ""); err != nil {
+			s.slackReply(payload.ResponseURL, "ephemeral", err.Error())
+			continue
+		}
+		s.jobLog(job).infof("Job %s was %s by %s in Slack", job.ID, status, by)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSlack records the Slack Web API calls
+type fakeSlack struct {
+	mu    sync.Mutex
+	calls map[string][]map[string]interface{}
+}
+
+func newFakeSlack() (*fakeSlack, *httptest.Server) {
+	slack := &fakeSlack{calls: make(map[string][]map[string]interface{})}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		slack.mu.Lock()
+		method := strings.TrimPrefix(r.URL.Path, "/")
+		slack.calls[method] = append(slack.calls[method], payload)
+		slack.mu.Unlock()
+		fmt.Fprint(w, `{"ok": true, "channel": "C1", "ts": "1485302400.000100"}`)
+	}))
+	return slack, server
+}
+
+func (f *fakeSlack) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls[method])
+}
+
+func signedSlackRequest(secret string, path string, body string) *http.Request {
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func Test_slackApproval(t *testing.T) {
+	slack, server := newFakeSlack()
+	defer server.Close()
+	slackAPIURL = server.URL
+	updater, _ := newApprovalUpdater()
+	updater.Config.SlackBotToken = "xoxb-test"
+	updater.Config.SlackChannel = "#deploys"
+	updater.Config.SlackSigningSecret = "signing"
+
+	job := updater.jobStore.create("myorg/api:2.0")
+	go updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	waitForApproval(t, job)
+	for i := 0; i < 100 && slack.count("chat.postMessage") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slack.count("chat.postMessage") != 1 {
+		t.Fatal("expected approval request to be posted")
+	}
+
+	payload := fmt.Sprintf(`{"type": "block_actions", "user": {"id": "U1", "username": "alice"}, "actions": [{"action_id": "approve", "value": "%s"}]}`, job.ID)
+	body := url.Values{"payload": {payload}}.Encode()
+
+	w := httptest.NewRecorder()
+	updater.slackActions(w, signedSlackRequest("wrong", "/slack/actions", body))
+	if w.Code != 401 {
+		t.Errorf("expected invalid signature to be rejected, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	updater.slackActions(w, signedSlackRequest("signing", "/slack/actions", body))
+	if w.Code != 200 {
+		t.Fatalf("expected action to be accepted, got %d %s", w.Code, w.Body.String())
+	}
+	waitForJob(t, job)
+	if job.Status != JobSucceeded || job.Approval.DecidedBy != "slack:alice" {
+		t.Errorf("expected job to be approved in Slack, got %s %+v", job.Status, job.Approval)
+	}
+	if slack.count("chat.update") != 1 || slack.calls["chat.update"][0]["ts"] != "1485302400.000100" {
+		t.Errorf("expected approval request to be updated, got %v", slack.calls["chat.update"])
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+	"github.com/rancher/go-rancher/client"
+)
+
+// rewriteImages replaces the image of each service in the docker-compose.yml
+func rewriteImages(compose string, images map[string]string) (string, error) {
+	for from, to := range images {
+		pattern := regexp.MustCompile(`(?m)^(\s*image:\s*["']?)` + regexp.QuoteMeta(from) + `(["']?\s*)$`)
+		if !pattern.MatchString(compose) {
+			return "", fmt.Errorf("Image %s not found in docker-compose.yml", from)
+		}
+		compose = pattern.ReplaceAllString(compose, "${1}"+strings.Replace(to, "$", "$$", -1)+"${2}")
+	}
+	return compose, nil
+}
+
+// stackByID loads the stack with the id, failing if it no longer exists
+func (s *ServiceUpdater) stackByID(id string) (*client.Environment, error) {
+	stack, err := s.stack.ById(id)
+	if err != nil {
+		return nil, err
+	}
+	if stack == nil {
+		return nil, fmt.Errorf("Stack %s not found", id)
+	}
+	return stack, nil
+}
+
+func (s *ServiceUpdater) waitForStackState(id string, state string, timeout time.Duration) (*client.Environment, error) {
+	result, err := utils.Retry(s.poll("poll stack "+state, func(t *ServiceUpdater) (interface{}, error) {
+		stack, e := t.stackByID(id)
+		if e != nil {
+			return nil, e
+		}
+		if stack.State != state {
+			return nil, fmt.Errorf("Stack %s not %s: %s", stack.Name, state, stack.State)
+		}
+		return stack, nil
+	}), timeout, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*client.Environment), nil
+}
+
+// upgradeStack upgrades all candidates of a stack at once by rewriting the images in the
+// exported docker-compose.yml and applying it as a stack upgrade. The stack is finished or
+// rolled back as a whole.
+func (s *ServiceUpdater) upgradeStack(job *Job, command UpdateCommand, stackID string, candidates []Candidate) {
+	var targets []*JobService
+	for _, c := range candidates {
+		event := c.event(command)
+		target := &JobService{
+			ServiceID:     c.Service.Id,
+			Service:       c.Service.Name,
+			Environment:   c.Environment,
+			StackID:       stackID,
+			FromImage:     event.FromImage,
+			ToImage:       event.ToImage,
+			LaunchConfigs: c.launchConfigs(),
+			Strategy:      StrategyStack,
+			Status:        ServiceUpgrading,
+		}
+		job.add(target)
+		targets = append(targets, target)
+	}
+	queued := func() {
+		var current []Candidate
+		var remaining []*JobService
+		for i, c := range candidates {
+			if c, ok := s.recheck(job, targets[i], command, c); ok {
+				current = append(current, c)
+				remaining = append(remaining, targets[i])
+			}
+		}
+		if len(current) > 0 {
+			s.runStack(job, command, stackID, current, remaining)
+		}
+	}
+	if !s.schedule(job, command, candidates, targets, queued) {
+		s.runStack(job, command, stackID, candidates, targets)
+	}
+}
+
+func (s *ServiceUpdater) runStack(job *Job, command UpdateCommand, stackID string, candidates []Candidate, targets []*JobService) {
+	events := make([]HookEvent, len(candidates))
+	for i, c := range candidates {
+		events[i] = c.event(command)
+	}
+	stackURL := fmt.Sprintf("%s/env/%s/apps/stacks/%s", s.Config.CattleURL, candidates[0].Service.AccountId, stackID)
+	fail := func(status string, err error) {
+		s.jobLog(job).errorf("Unable to upgrade stack %s: %s", stackID, err.Error())
+		s.slackMessage(s.jobLog(job), "danger", fmt.Sprintf("Unable to upgrade stack to `%s`: %s\nCheck status at <%s|stack>", events[0].ToVersion, err.Error(), stackURL))
+		job.update(func() {
+			for _, target := range targets {
+				target.Status = status
+				target.Error = err.Error()
+			}
+		})
+		for _, event := range events {
+			event.Error = err.Error()
+			s.runHooks(HookOnFailure, event)
+		}
+	}
+
+	for _, event := range events {
+		if err := s.runHooks(HookPreUpgrade, event); err != nil {
+			fail(ServiceAborted, err)
+			return
+		}
+	}
+
+	stack, err := s.stackByID(stackID)
+	if err != nil {
+		fail(ServiceFailed, err)
+		return
+	}
+	serviceIds := make([]string, len(candidates))
+	images := make(map[string]string)
+	for i, c := range candidates {
+		serviceIds[i] = c.Service.Id
+		for _, image := range c.fromImages() {
+			images[strings.TrimPrefix(image, "docker:")] = strings.TrimPrefix(command.Image, "docker:")
+		}
+	}
+	config, err := s.stack.ActionExportconfig(stack, &client.ComposeConfigInput{ServiceIds: serviceIds})
+	if err != nil {
+		fail(ServiceFailed, err)
+		return
+	}
+	compose, err := rewriteImages(config.DockerComposeConfig, images)
+	if err != nil {
+		fail(ServiceFailed, err)
+		return
+	}
+
+	s.jobLog(job).infof("Upgrading stack %s", stack.Name)
+	for _, target := range targets {
+		s.metrics.upgradeStarted(targetTags(target))
+	}
+	_, err = s.stack.ActionUpgrade(stack, &client.EnvironmentUpgrade{
+		DockerCompose:  compose,
+		RancherCompose: config.RancherComposeConfig,
+		Environment:    stack.Environment,
+		ExternalId:     stack.ExternalId,
+	})
+	if err != nil {
+		fail(ServiceFailed, err)
+		return
+	}
+	upgraded, err := s.waitForStackState(stackID, "upgraded", time.Duration(command.Timeout)*time.Second)
+	if err != nil {
+		fail(ServiceFailed, err)
+		return
+	}
+	if !command.Confirm {
+		job.update(func() {
+			for _, target := range targets {
+				target.Status = ServiceUpgraded
+			}
+		})
+		for _, event := range events {
+			s.runHooks(HookPostUpgrade, event)
+		}
+		return
+	}
+
+	err = s.verifyStack(candidates, events)
+	if err == nil {
+		_, err = s.stack.ActionFinishupgrade(upgraded)
+	}
+	if err != nil {
+		_, rollbackErr := s.stack.ActionRollback(upgraded)
+		s.auditRollback("updater", map[string]interface{}{"stack": upgraded.Name, "stack_id": upgraded.Id, "reason": err.Error()}, rollbackErr)
+		if rollbackErr != nil {
+			fail(ServiceFailed, fmt.Errorf("%s, rollback failed: %s", err, rollbackErr))
+			return
+		}
+		fail(ServiceRolledBack, err)
+		return
+	}
+
+	s.jobLog(job).infof("Upgraded stack %s to %s", stack.Name, command.Image)
+	names := make([]string, len(candidates))
+	for i, c := range candidates {
+		names[i] = c.Service.Name
+	}
+	s.slackMessage(s.jobLog(job), "good", fmt.Sprintf("Stack `%s` has been successfully upgraded to `%s` in %s (%s)\n View in Rancher here: <%s|%[1]s>",
+		stack.Name, events[0].ToVersion, candidates[0].Environment, strings.Join(names, ", "), stackURL))
+	job.update(func() {
+		for _, target := range targets {
+			target.Status = ServiceSucceeded
+		}
+	})
+	for _, event := range events {
+		s.runHooks(HookPostUpgrade, event)
+	}
+}
+
+// verifyStack runs the verification and pre_finish hooks of every upgraded service of the stack
+func (s *ServiceUpdater) verifyStack(candidates []Candidate, events []HookEvent) error {
+	for i, c := range candidates {
+		svc, err := s.serviceByID(c.Service.Id)
+		if err != nil {
+			return err
+		}
+		if err := s.verifyService(*svc, events[i].ToImage); err != nil {
+			return err
+		}
+		if err := s.runHooks(HookPreFinish, events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
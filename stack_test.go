@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+const testCompose = `version: '2'
+services:
+  api:
+    image: myorg/api:1.0
+    labels:
+      autoupdate.enable: 'true'
+  worker:
+    image: "myorg/api:1.0"
+  db:
+    image: postgres:9.6
+`
+
+type mockStack struct {
+	state    string
+	upgrade  *client.EnvironmentUpgrade
+	finished bool
+	rolled   bool
+	removed  bool
+}
+
+func (m *mockStack) ById(id string) (*client.Environment, error) {
+	if m.removed {
+		return nil, nil
+	}
+	return &client.Environment{Resource: client.Resource{Id: id}, Name: "shop", State: m.state}, nil
+}
+
+func (m *mockStack) ActionExportconfig(stack *client.Environment, input *client.ComposeConfigInput) (*client.ComposeConfig, error) {
+	return &client.ComposeConfig{DockerComposeConfig: testCompose}, nil
+}
+
+func (m *mockStack) ActionFinishupgrade(stack *client.Environment) (*client.Environment, error) {
+	m.finished = true
+	return stack, nil
+}
+
+func (m *mockStack) ActionRollback(stack *client.Environment) (*client.Environment, error) {
+	m.rolled = true
+	return stack, nil
+}
+
+func (m *mockStack) ActionUpgrade(stack *client.Environment, upgrade *client.EnvironmentUpgrade) (*client.Environment, error) {
+	m.upgrade = upgrade
+	m.state = "upgraded"
+	return stack, nil
+}
+
+func Test_rewriteImages(t *testing.T) {
+	compose, err := rewriteImages(testCompose, map[string]string{"myorg/api:1.0": "myorg/api:2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(compose, "    image: myorg/api:2.0\n") || !strings.Contains(compose, `    image: "myorg/api:2.0"`) {
+		t.Errorf("expected api images to be rewritten:\n%s", compose)
+	}
+	if !strings.Contains(compose, "image: postgres:9.6") {
+		t.Errorf("expected other images to be untouched:\n%s", compose)
+	}
+	if _, err := rewriteImages(testCompose, map[string]string{"myorg/web:1.0": "myorg/web:2.0"}); err == nil {
+		t.Error("expected missing image to fail")
+	}
+}
+
+func Test_upgradeStack(t *testing.T) {
+	api := testService(map[string]interface{}{strategyLabel: StrategyStack})
+	api.EnvironmentId = "1e1"
+	worker := testService(map[string]interface{}{strategyLabel: StrategyStack})
+	worker.Id, worker.Name, worker.EnvironmentId = "1s2", "worker", "1e1"
+	updater, service := newTestUpdater(api, worker)
+	stack := &mockStack{state: "active"}
+	updater.stack = stack
+
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if job.Status != JobSucceeded || len(job.Services) != 2 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if len(service.upgrades) != 0 {
+		t.Error("expected no service level upgrades")
+	}
+	if stack.upgrade == nil || strings.Count(stack.upgrade.DockerCompose, "myorg/api:2.0") != 2 || !stack.finished {
+		t.Errorf("expected stack to be upgraded and finished, got %+v", stack.upgrade)
+	}
+}
+
+func Test_upgradeStackRemoved(t *testing.T) {
+	api := testService(map[string]interface{}{strategyLabel: StrategyStack})
+	api.EnvironmentId = "1e1"
+	updater, _ := newTestUpdater(api)
+	stack := &mockStack{state: "active", removed: true}
+	updater.stack = stack
+
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if job.Status != JobFailed || job.Services[0].Error != "Stack 1e1 not found" {
+		t.Fatalf("expected the removed stack to fail the job, got %+v", job.Services[0])
+	}
+	if stack.upgrade != nil {
+		t.Errorf("expected no stack upgrade")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	//StatsDFlavor sends plain StatsD metrics without tags
+	StatsDFlavor = "statsd"
+	//DogStatsDFlavor sends DogStatsD metrics with tags
+	DogStatsDFlavor = "dogstatsd"
+)
+
+// metricTags identifies the service an event is about. Prometheus only uses the environment,
+// StatsD sends all of them as tags.
+type metricTags struct {
+	Environment string
+	Stack       string
+	Service     string
+	Image       string
+}
+
+// targetTags returns the tags of a service upgrade
+func targetTags(target *JobService) metricTags {
+	return metricTags{
+		Environment: target.Environment,
+		Stack:       target.StackID,
+		Service:     target.Service,
+		Image:       strings.TrimPrefix(target.ToImage, "docker:"),
+	}
+}
+
+func (t metricTags) pairs() []string {
+	var pairs []string
+	for _, tag := range [][2]string{{"environment", t.Environment}, {"stack", t.Stack}, {"service", t.Service}, {"image", t.Image}} {
+		if tag[1] != "" {
+			pairs = append(pairs, tag[0], tag[1])
+		}
+	}
+	return pairs
+}
+
+// StatsD sends metrics over UDP to a StatsD or DogStatsD agent
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+}
+
+// newStatsD connects to the agent at the address. Metric names are prefixed with the prefix and a dot.
+func newStatsD(address string, prefix string, flavor string) (*StatsD, error) {
+	if flavor != StatsDFlavor && flavor != DogStatsDFlavor {
+		return nil, fmt.Errorf("Unknown StatsD flavor %s, expected statsd or dogstatsd", flavor)
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsD{conn: conn, prefix: prefix, tags: flavor == DogStatsDFlavor}, nil
+}
+
+// send writes one metric, tagged with the label pairs if the agent supports tags.
+// Metrics are best effort and send errors are ignored.
+func (s *StatsD) send(name string, value string, kind string, pairs ...string) {
+	if s == nil {
+		return
+	}
+	line := fmt.Sprintf("%s%s:%s|%s", s.prefix, name, value, kind)
+	if s.tags && len(pairs) > 0 {
+		var tags []string
+		for i := 0; i+1 < len(pairs); i += 2 {
+			tag := strings.NewReplacer(",", "_", "|", "_", "#", "_").Replace(pairs[i+1])
+			tags = append(tags, fmt.Sprintf("%s:%s", pairs[i], tag))
+		}
+		line = fmt.Sprintf("%s|#%s", line, strings.Join(tags, ","))
+	}
+	s.conn.Write([]byte(line))
+}
+
+func (s *StatsD) count(name string, pairs ...string) {
+	s.send(name, "1", "c", pairs...)
+}
+
+func (s *StatsD) gauge(name string, value float64, pairs ...string) {
+	s.send(name, fmt.Sprint(value), "g", pairs...)
+}
+
+func (s *StatsD) timing(name string, d time.Duration, pairs ...string) {
+	s.send(name, fmt.Sprintf("%.3f", d.Seconds()*1000), "ms", pairs...)
+}
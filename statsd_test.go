@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenStatsD returns a local UDP listener and a function reading the next metrics sent to it
+func listenStatsD(t *testing.T) (net.PacketConn, func() string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func Test_newStatsD(t *testing.T) {
+	if _, err := newStatsD("127.0.0.1:8125", "", "graphite"); err == nil {
+		t.Error("expected an error for an unknown flavor")
+	}
+	var s *StatsD
+	s.count("triggers")
+}
+
+func Test_statsdFlavors(t *testing.T) {
+	conn, read := listenStatsD(t)
+	defer conn.Close()
+
+	dog, err := newStatsD(conn.LocalAddr().String(), "updater", DogStatsDFlavor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dog.count("triggers", "source", "api", "outcome", "a,b|c")
+	if line := read(); line != "updater.triggers:1|c|#source:api,outcome:a_b_c" {
+		t.Errorf("unexpected metric %s", line)
+	}
+	dog.timing("confirm.duration", 1500*time.Millisecond)
+	if line := read(); line != "updater.confirm.duration:1500.000|ms" {
+		t.Errorf("unexpected metric %s", line)
+	}
+
+	plain, err := newStatsD(conn.LocalAddr().String(), "updater.", StatsDFlavor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.gauge("queue.depth", 3, "environment", "dev")
+	if line := read(); line != "updater.queue.depth:3|g" {
+		t.Errorf("unexpected metric %s", line)
+	}
+}
+
+func Test_statsdEvents(t *testing.T) {
+	conn, read := listenStatsD(t)
+	defer conn.Close()
+
+	svc := testService(map[string]interface{}{})
+	svc.EnvironmentId = "1e1"
+	updater, _ := newTestUpdater(svc)
+	statsd, err := newStatsD(conn.LocalAddr().String(), "rancher_updater", DogStatsDFlavor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater.metrics.statsd = statsd
+	updater.upgrade(httptest.NewRecorder(), httptest.NewRequest("POST", "/upgrade", strings.NewReader(`{"docker_image": "myorg/api:2.0", "confirm": true, "timeout": 1}`)))
+
+	tags := "environment:dev,stack:1e1,service:api,image:myorg/api:2.0"
+	expected := []string{
+		"rancher_updater.triggers:1|c|#source:api,outcome:accepted",
+		"rancher_updater.upgrades.started:1|c|#" + tags,
+		"rancher_updater.confirm.duration:",
+		"rancher_updater.upgrades.finished:1|c|#" + tags + ",outcome:succeeded",
+		"rancher_updater.last_success:",
+	}
+	for _, prefix := range expected {
+		line := read()
+		for strings.HasPrefix(line, "rancher_updater.rancher.") {
+			line = read()
+		}
+		if !strings.HasPrefix(line, prefix) {
+			t.Errorf("expected %s, got %s", prefix, line)
+		}
+	}
+}
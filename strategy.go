@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+	"github.com/rancher/go-rancher/client"
+)
+
+const (
+	batchSizeLabel  = "autoupdate.batch_size"
+	intervalLabel   = "autoupdate.interval"
+	strategyLabel   = "autoupdate.strategy"
+	canaryBakeLabel = "autoupdate.canary.bake"
+
+	//StrategyRolling is the Rancher in-service upgrade in batches
+	StrategyRolling = "rolling"
+	//StrategyCanary upgrades one container and bakes it before the remaining batches
+	StrategyCanary = "canary"
+	//StrategyBlueGreen moves traffic to a sibling service running the new image
+	StrategyBlueGreen = "bluegreen"
+	//StrategyStack upgrades all services of a stack at once through Rancher compose
+	StrategyStack = "stack"
+
+	//StageCanary is a canary upgrade waiting for its first container
+	StageCanary = "canary"
+	//StageBaking is a canary upgrade checking its first container
+	StageBaking = "baking"
+	//StageRolling is a canary upgrade rolling the remaining batches
+	StageRolling = "rolling"
+	//StageRolledBack is a canary upgrade that was rolled back
+	StageRolledBack = "rolled_back"
+)
+
+var canaryCheckInterval = 5 * time.Second
+
+// canaryHoldMargin is added to the hold of a canary upgrade, so that Rancher does not roll
+// the second batch while the canary is still being found or verified
+const canaryHoldMargin = 5 * time.Minute
+
+// batchSettings returns the batch size and interval in milliseconds for the
+// in-service upgrade of the service. Labels take precedence over the command.
+// Canary upgrades roll the canary container alone and then hold: the interval
+// outlasts the wait for the canary, its bake and its verification, and the
+// updater cancels the held upgrade to roll the remaining batches itself.
+func batchSettings(command UpdateCommand, service client.Service) (int64, int64, error) {
+	if strategyFor(command, service) == StrategyCanary {
+		bake, err := canaryBake(command, service)
+		hold := bake + time.Duration(command.Timeout)*time.Second + canaryHoldMargin
+		return 1, int64(hold / time.Millisecond), err
+	}
+	return rollingSettings(command, service)
+}
+
+// rollingSettings returns the batch size and interval in milliseconds of a rolling upgrade
+func rollingSettings(command UpdateCommand, service client.Service) (int64, int64, error) {
+	batchSize, interval := command.BatchSize, command.Interval
+	if service.LaunchConfig != nil {
+		labelBatch, err := labelInt(service.LaunchConfig.Labels, batchSizeLabel, int(batchSize))
+		if err != nil {
+			return 0, 0, err
+		}
+		labelInterval, err := labelInt(service.LaunchConfig.Labels, intervalLabel, int(interval))
+		if err != nil {
+			return 0, 0, err
+		}
+		batchSize, interval = int64(labelBatch), int64(labelInterval)
+	}
+	if batchSize < 0 {
+		return 0, 0, fmt.Errorf("Invalid batch size %d for %s", batchSize, service.Name)
+	}
+	if service.Scale > 0 && batchSize > service.Scale {
+		return 0, 0, fmt.Errorf("Batch size %d for %s is larger than its scale %d", batchSize, service.Name, service.Scale)
+	}
+	if interval < 0 {
+		return 0, 0, fmt.Errorf("Invalid interval %d for %s", interval, service.Name)
+	}
+	return batchSize, interval, nil
+}
+
+// strategyFor returns the upgrade strategy of the service. Labels take precedence over the command.
+func strategyFor(command UpdateCommand, service client.Service) string {
+	if service.LaunchConfig != nil {
+		if strategy, ok := label(service.LaunchConfig.Labels, strategyLabel); ok && strategy != "" {
+			return strategy
+		}
+	}
+	if command.Strategy != "" {
+		return command.Strategy
+	}
+	return StrategyRolling
+}
+
+func canaryBake(command UpdateCommand, service client.Service) (time.Duration, error) {
+	bake := command.CanaryBake
+	if bake == 0 {
+		bake = 60
+	}
+	if service.LaunchConfig != nil {
+		var err error
+		if bake, err = labelInt(service.LaunchConfig.Labels, canaryBakeLabel, bake); err != nil {
+			return 0, err
+		}
+	}
+	if bake <= 0 {
+		return 0, fmt.Errorf("Invalid canary bake period %d for %s", bake, service.Name)
+	}
+	return time.Duration(bake) * time.Second, nil
+}
+
+// runCanary watches the first upgraded container of a canary upgrade for the
+// bake period, while Rancher holds the upgrade after it. Once the canary passed,
+// the held upgrade is cancelled and the remaining batches are rolled with the
+// rolling settings. If the canary fails, the upgrade is cancelled and rolled back.
+func (s *ServiceUpdater) runCanary(job *Job, target *JobService, command UpdateCommand, c Candidate) error {
+	service := c.Service
+	service.LaunchConfig = c.launchConfig(command.Image)
+	log := s.jobLog(job).forTarget(target)
+	bake, err := canaryBake(command, service)
+	if err != nil {
+		return err
+	}
+	_, err = utils.Retry(s.poll("poll canary", func(t *ServiceUpdater) (interface{}, error) {
+		containers, err := t.newContainers(service, command.Image)
+		if err != nil {
+			return nil, err
+		}
+		if len(containers) == 0 {
+			return nil, fmt.Errorf("Canary container of %s is not running", service.Name)
+		}
+		return containers, nil
+	}), time.Duration(command.Timeout)*time.Second, 3*time.Second)
+	if err == nil {
+		job.update(func() { target.Stage = StageBaking })
+		log.infof("Baking canary of %s for %s", service.Name, bake)
+		err = s.bakeCanary(service, command.Image, bake)
+	}
+	if err != nil {
+		log.warnf("Canary of %s failed, rolling back: %s", service.Name, err)
+		return s.abortCanary(job, target, service, "canary failed", fmt.Errorf("Canary failed: %s", err))
+	}
+	job.update(func() { target.Stage = StageRolling })
+	if err := s.resumeCanary(log, command, c); err != nil {
+		log.warnf("Unable to roll the remaining batches of %s, rolling back: %s", service.Name, err)
+		return s.abortCanary(job, target, service, "canary not resumed", fmt.Errorf("Unable to roll the remaining batches: %s", err))
+	}
+	return nil
+}
+
+// abortCanary rolls back a canary upgrade that failed with the cause
+func (s *ServiceUpdater) abortCanary(job *Job, target *JobService, service client.Service, reason string, cause error) error {
+	rollbackErr := s.rollbackUpgrade(service)
+	s.auditRollback("updater", map[string]interface{}{"service": service.Name, "service_id": service.Id, "reason": reason}, rollbackErr)
+	if rollbackErr != nil {
+		return fmt.Errorf("%s, rollback failed: %s", cause, rollbackErr)
+	}
+	job.update(func() { target.Stage = StageRolledBack })
+	return cause
+}
+
+// resumeCanary cancels the held canary upgrade and upgrades the remaining containers in
+// batches. A service whose only container was the canary is already upgraded.
+func (s *ServiceUpdater) resumeCanary(log *Logger, command UpdateCommand, c Candidate) error {
+	current, err := s.serviceByID(c.Service.Id)
+	if err != nil {
+		return err
+	}
+	if current.State == "upgraded" {
+		return nil
+	}
+	if _, err := s.cancelUpgrade(*current); err != nil {
+		return err
+	}
+	batchSize, interval, err := rollingSettings(command, c.Service)
+	if err != nil {
+		return err
+	}
+	log.infof("Canary of %s passed, upgrading the remaining containers", c.Service.Name)
+	return s.startInService(log, command, c, batchSize, interval)
+}
+
+func (s *ServiceUpdater) bakeCanary(service client.Service, image string, bake time.Duration) error {
+	if err := s.verifyService(service, image); err != nil {
+		return err
+	}
+	done := time.After(bake)
+	for {
+		select {
+		case <-done:
+			return s.verifyService(service, image)
+		case <-time.After(canaryCheckInterval):
+			current, err := s.serviceByID(service.Id)
+			if err != nil {
+				return err
+			}
+			if current.HealthState == "unhealthy" {
+				return fmt.Errorf("Service %s is unhealthy", service.Name)
+			}
+		}
+	}
+}
+
+// cancelUpgrade cancels the upgrade of an upgrading service and waits until it is canceled
+func (s *ServiceUpdater) cancelUpgrade(service client.Service) (*client.Service, error) {
+	if _, err := s.service.ActionCancelupgrade(&service); err != nil {
+		return nil, err
+	}
+	canceled, err := utils.Retry(s.poll("poll canceled-upgrade", func(t *ServiceUpdater) (interface{}, error) {
+		c, e := t.serviceByID(service.Id)
+		if e != nil {
+			return nil, e
+		}
+		if c.State != "canceled-upgrade" {
+			return nil, fmt.Errorf("Service upgrade not canceled: %s", c.State)
+		}
+		return c, nil
+	}), 60*time.Second, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return canceled.(*client.Service), nil
+}
+
+// rollbackUpgrade cancels a running upgrade and rolls the service back
+func (s *ServiceUpdater) rollbackUpgrade(service client.Service) error {
+	current, err := s.serviceByID(service.Id)
+	if err != nil {
+		return err
+	}
+	if current.State == "upgrading" {
+		if current, err = s.cancelUpgrade(*current); err != nil {
+			return err
+		}
+	}
+	_, err = s.service.ActionRollback(current)
+	return err
+}
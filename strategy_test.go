@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func Test_batchSettings(t *testing.T) {
+	service := client.Service{Name: "api", Scale: 4, LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{}}}
+	command := UpdateCommand{BatchSize: 2, Interval: 5000}
+
+	batch, interval, err := batchSettings(command, service)
+	if err != nil || batch != 2 || interval != 5000 {
+		t.Errorf("expected command settings, got %d %d %v", batch, interval, err)
+	}
+
+	service.LaunchConfig.Labels[batchSizeLabel] = "1"
+	service.LaunchConfig.Labels[intervalLabel] = "10000"
+	batch, interval, err = batchSettings(command, service)
+	if err != nil || batch != 1 || interval != 10000 {
+		t.Errorf("expected labels to take precedence, got %d %d %v", batch, interval, err)
+	}
+
+	service.LaunchConfig.Labels[batchSizeLabel] = "5"
+	if _, _, err := batchSettings(command, service); err == nil {
+		t.Error("expected batch size larger than scale to fail")
+	}
+
+	service.LaunchConfig.Labels[batchSizeLabel] = "two"
+	if _, _, err := batchSettings(command, service); err == nil {
+		t.Error("expected invalid label to fail")
+	}
+}
+
+func Test_rollbackUpgradeRemoved(t *testing.T) {
+	updater, service := newTestUpdater()
+	err := updater.rollbackUpgrade(testService(map[string]interface{}{}))
+	if err == nil || err.Error() != "Service 1s1 not found" {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if len(service.rolledBack) != 0 {
+		t.Errorf("expected no rollback")
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	//TraceStdout writes every finished span as a JSON line to stdout
+	TraceStdout = "stdout"
+	//TraceOTLP sends the finished spans to an OTLP/HTTP collector in the JSON encoding
+	TraceOTLP = "otlp"
+
+	traceparentHeader = "traceparent"
+	traceServiceName  = "rancher-service-updater"
+	traceBatchSize    = 64
+	traceFlushPeriod  = 5 * time.Second
+)
+
+// Span kinds of OTLP
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s"']+`)
+
+var traceparentRegexp = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// Span is a timed operation of a trace. A nil Span records nothing, so that code can trace
+// without checking whether tracing is enabled.
+type Span struct {
+	tracer     *Tracer
+	mu         sync.Mutex
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Kind       int               `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	sampled    bool
+}
+
+// spanExporter sends finished spans to a tracing backend
+type spanExporter interface {
+	export(spans []*Span) error
+}
+
+// Tracer starts spans and exports them in batches once they end. A nil Tracer starts no spans.
+type Tracer struct {
+	mu       sync.Mutex
+	exporter spanExporter
+	batch    int
+	pending  []*Span
+	log      *Logger
+}
+
+func newTracer(exporter spanExporter, batch int, log *Logger) *Tracer {
+	return &Tracer{exporter: exporter, batch: batch, log: log}
+}
+
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// start starts a span, a child of the parent if there is one and the root of a new trace otherwise
+func (t *Tracer) start(parent *Span, name string, kind int, attributes ...string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		tracer:     t,
+		TraceID:    randomID(16),
+		SpanID:     randomID(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		sampled:    true,
+	}
+	if parent != nil {
+		span.TraceID, span.ParentID, span.sampled = parent.TraceID, parent.SpanID, parent.sampled
+	}
+	span.set(attributes...)
+	return span
+}
+
+// startRemote starts a span continuing the trace of a W3C traceparent header. An invalid or
+// missing header starts a new trace.
+func (t *Tracer) startRemote(traceparent string, name string, kind int, attributes ...string) *Span {
+	span := t.start(nil, name, kind, attributes...)
+	if m := traceparentRegexp.FindStringSubmatch(traceparent); span != nil && m != nil &&
+		m[1] != "00000000000000000000000000000000" && m[2] != "0000000000000000" {
+		flags, _ := hex.DecodeString(m[3])
+		span.TraceID, span.ParentID, span.sampled = m[1], m[2], flags[0]&1 == 1
+	}
+	return span
+}
+
+// child starts a span of the same trace
+func (sp *Span) child(name string, kind int, attributes ...string) *Span {
+	if sp == nil {
+		return nil
+	}
+	return sp.tracer.start(sp, name, kind, attributes...)
+}
+
+// set adds key value pairs to the attributes of the span
+func (sp *Span) set(pairs ...string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		sp.Attributes[pairs[i]] = pairs[i+1]
+	}
+}
+
+// finish ends the span, recording the error if there is one
+func (sp *Span) finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	if !sp.End.IsZero() {
+		sp.mu.Unlock()
+		return
+	}
+	sp.End = time.Now()
+	if err != nil {
+		sp.Error = sp.tracer.redact(err.Error())
+	}
+	sp.mu.Unlock()
+	if sp.sampled {
+		sp.tracer.add(sp)
+	}
+}
+
+// traceparent returns the W3C traceparent header of the span
+func (sp *Span) traceparent() string {
+	if sp == nil {
+		return ""
+	}
+	flags := "00"
+	if sp.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sp.TraceID, sp.SpanID, flags)
+}
+
+// traceID returns the id of the trace of the span, if there is one
+func (sp *Span) traceID() string {
+	if sp == nil {
+		return ""
+	}
+	return sp.TraceID
+}
+
+// redact removes the configured secrets and the credentials and queries of URLs from a span error,
+// e.g. the webhook URL of a failed Slack request
+func (t *Tracer) redact(text string) string {
+	text = urlRegexp.ReplaceAllStringFunc(text, redactURL)
+	return t.log.redactString(text)
+}
+
+func (t *Tracer) add(span *Span) {
+	t.mu.Lock()
+	t.pending = append(t.pending, span)
+	full := len(t.pending) >= t.batch
+	t.mu.Unlock()
+	if full {
+		t.flush()
+	}
+}
+
+// flush exports the finished spans
+func (t *Tracer) flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.export(spans); err != nil {
+		t.log.warnf("Unable to export %d span(s): %s", len(spans), err)
+	}
+}
+
+// run flushes the finished spans periodically
+func (t *Tracer) run(period time.Duration) {
+	for range time.Tick(period) {
+		t.flush()
+	}
+}
+
+// stdoutExporter writes every span as a JSON line
+type stdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *stdoutExporter) export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range spans {
+		span.mu.Lock()
+		line, err := json.Marshal(span)
+		span.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if _, err := e.w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter posts spans to an OTLP/HTTP endpoint, e.g. http://collector:4318/v1/traces
+type otlpExporter struct {
+	endpoint string
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpRequest is the body of an OTLP/HTTP trace export request in the JSON encoding
+func otlpRequest(spans []*Span) map[string]interface{} {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mu.Lock()
+		s := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: fmt.Sprint(span.Start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprint(span.End.UnixNano()),
+			Status:            otlpStatus{Code: 1},
+		}
+		for _, key := range sortedAttributes(span.Attributes) {
+			s.Attributes = append(s.Attributes, otlpAttribute{key, otlpValue{span.Attributes[key]}})
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		span.mu.Unlock()
+		converted = append(converted, s)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{"service.name", otlpValue{traceServiceName}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": traceServiceName},
+				"spans": converted,
+			}},
+		}},
+	}
+}
+
+func sortedAttributes(attributes map[string]string) []string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *otlpExporter) export(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := hookClient.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP endpoint %s responded %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// newTracing creates the tracer of the exporter, or no tracer if the exporter is empty
+func newTracing(exporter string, endpoint string, log *Logger) (*Tracer, error) {
+	switch exporter {
+	case "":
+		return nil, nil
+	case TraceStdout:
+		return newTracer(&stdoutExporter{w: os.Stdout}, 1, log), nil
+	case TraceOTLP:
+		tracer := newTracer(&otlpExporter{endpoint: endpoint}, traceBatchSize, log)
+		go tracer.run(traceFlushPeriod)
+		return tracer, nil
+	}
+	return nil, fmt.Errorf("Unknown trace exporter %s, expected stdout or otlp", exporter)
+}
+
+// withSpan returns a copy of the updater recording the Rancher calls and notifications it makes
+// as children of the span
+func (s *ServiceUpdater) withSpan(span *Span) *ServiceUpdater {
+	if span == nil {
+		return s
+	}
+	traced := *s
+	traced.span = span
+	if i, ok := s.service.(instrumentedService); ok {
+		i.span = span
+		traced.service = i
+	}
+	if i, ok := s.account.(instrumentedAccount); ok {
+		i.span = span
+		traced.account = i
+	}
+	if i, ok := s.stack.(instrumentedStack); ok {
+		i.span = span
+		traced.stack = i
+	}
+	if i, ok := s.container.(instrumentedContainer); ok {
+		i.span = span
+		traced.container = i
+	}
+	if i, ok := s.base.(instrumentedBase); ok {
+		i.span = span
+		traced.base = i
+	}
+	return &traced
+}
+
+type spanKey struct{}
+
+// trace records the request as a server span continuing the trace of its traceparent header.
+// Handlers get the updater tracing their calls with s.traced(r).
+func (s *ServiceUpdater) trace(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		span := s.tracer.startRemote(r.Header.Get(traceparentHeader), fmt.Sprintf("%s %s", r.Method, r.URL.Path), spanServer,
+			"http.method", r.Method, "http.target", r.URL.Path)
+		if span == nil {
+			next(w, r)
+			return
+		}
+		w.Header().Set(traceparentHeader, span.traceparent())
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		next(recorder, r.WithContext(context.WithValue(r.Context(), spanKey{}, span)))
+		span.set("http.status_code", fmt.Sprint(recorder.status))
+		var err error
+		if recorder.status >= 500 {
+			err = fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status))
+		}
+		span.finish(err)
+	}
+}
+
+// traced returns the updater recording its calls as children of the span of the request
+func (s *ServiceUpdater) traced(r *http.Request) *ServiceUpdater {
+	span, _ := r.Context().Value(spanKey{}).(*Span)
+	return s.withSpan(span)
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// poll returns a retried check recording every attempt as a span, with the Rancher calls of
+// the attempt as its children
+func (s *ServiceUpdater) poll(name string, attempt func(t *ServiceUpdater) (interface{}, error)) utils.RetryFunc {
+	return func() (interface{}, error) {
+		span := s.span.child(name, spanInternal)
+		result, err := attempt(s.withSpan(span))
+		span.finish(err)
+		return result, err
+	}
+}
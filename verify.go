@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+const (
+	verifyURLLabel      = "autoupdate.verify.url"
+	verifyStatusLabel   = "autoupdate.verify.status"
+	verifyBodyLabel     = "autoupdate.verify.body"
+	verifyRetriesLabel  = "autoupdate.verify.retries"
+	verifyIntervalLabel = "autoupdate.verify.interval"
+	onFailureLabel      = "autoupdate.on_failure"
+
+	//FailurePolicyNone leaves a failed upgrade in place for manual attention
+	FailurePolicyNone = "none"
+	//FailurePolicyRollback rolls a failed upgrade back to the previous launch config
+	FailurePolicyRollback = "rollback"
+)
+
+// Probe is an HTTP smoke-test declared through service labels
+type Probe struct {
+	URL      string
+	Status   int
+	Body     *regexp.Regexp
+	Retries  int
+	Interval time.Duration
+}
+
+var probeClient = &http.Client{Timeout: 10 * time.Second}
+
+func label(labels map[string]interface{}, key string) (string, bool) {
+	value, ok := labels[key]
+	if !ok || value == nil {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+func labelInt(labels map[string]interface{}, key string, defaultValue int) (int, error) {
+	value, ok := label(labels, key)
+	if !ok || value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse label %s [%s] as integer", key, value)
+	}
+	return i, nil
+}
+
+func probeFromLabels(labels map[string]interface{}) (*Probe, error) {
+	url, ok := label(labels, verifyURLLabel)
+	if !ok || url == "" {
+		return nil, nil
+	}
+	probe := &Probe{URL: url}
+	var err error
+	if probe.Status, err = labelInt(labels, verifyStatusLabel, 200); err != nil {
+		return nil, err
+	}
+	if probe.Retries, err = labelInt(labels, verifyRetriesLabel, 3); err != nil {
+		return nil, err
+	}
+	interval, err := labelInt(labels, verifyIntervalLabel, 5)
+	if err != nil {
+		return nil, err
+	}
+	probe.Interval = time.Duration(interval) * time.Second
+	if body, ok := label(labels, verifyBodyLabel); ok && body != "" {
+		if probe.Body, err = regexp.Compile(body); err != nil {
+			return nil, fmt.Errorf("Invalid regex in label %s: %s", verifyBodyLabel, err)
+		}
+	}
+	return probe, nil
+}
+
+func (p *Probe) check() error {
+	resp, err := probeClient.Get(p.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != p.Status {
+		return fmt.Errorf("Probe %s returned status %d, expected %d", p.URL, resp.StatusCode, p.Status)
+	}
+	if p.Body != nil && !p.Body.Match(body) {
+		return fmt.Errorf("Probe %s response did not match %s", p.URL, p.Body)
+	}
+	return nil
+}
+
+func (p *Probe) run() error {
+	var err error
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.Interval)
+		}
+		if err = p.check(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyService runs the probe and the exec check declared by the service, the exec check in
+// the containers running the upgraded image
+func (s *ServiceUpdater) verifyService(service client.Service, image string) error {
+	if service.LaunchConfig == nil {
+		return nil
+	}
+	probe, err := probeFromLabels(service.LaunchConfig.Labels)
+	if err != nil {
+		return err
+	}
+	if probe != nil {
+		s.log.debugf("Verifying service %s with probe %s", service.Name, probe.URL)
+		if err := probe.run(); err != nil {
+			return fmt.Errorf("Verification of %s failed: %s", service.Name, err)
+		}
+	}
+	check, err := execCheckFromLabels(service.LaunchConfig.Labels)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		s.log.debugf("Verifying service %s with command %q", service.Name, check.Command)
+		if err := s.verifyExec(service, image, check); err != nil {
+			return fmt.Errorf("Verification of %s failed: %s", service.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *ServiceUpdater) failurePolicy(service client.Service) string {
+	if service.LaunchConfig != nil {
+		if policy, ok := label(service.LaunchConfig.Labels, onFailureLabel); ok && policy != "" {
+			return policy
+		}
+	}
+	return s.Config.FailurePolicy
+}
+
+func (s *ServiceUpdater) handleFailure(service client.Service) error {
+	switch policy := s.failurePolicy(service); policy {
+	case FailurePolicyRollback:
+		s.log.warnf("Rolling back service %s", service.Name)
+		err := s.rollbackUpgrade(service)
+		s.auditRollback("updater", map[string]interface{}{"service": service.Name, "service_id": service.Id, "reason": "failure policy"}, err)
+		return err
+	case FailurePolicyNone, "":
+		return nil
+	default:
+		return fmt.Errorf("Unknown failure policy %s for service %s", policy, service.Name)
+	}
+}
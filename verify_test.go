@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func Test_probeFromLabels(t *testing.T) {
+	probe, err := probeFromLabels(map[string]interface{}{"autoupdate.enable": "true"})
+	if err != nil || probe != nil {
+		t.Fatalf("expected no probe without %s, got %v %v", verifyURLLabel, probe, err)
+	}
+
+	probe, err = probeFromLabels(map[string]interface{}{
+		verifyURLLabel:     "http://app/health",
+		verifyStatusLabel:  "204",
+		verifyRetriesLabel: "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Status != 204 || probe.Retries != 0 || probe.Body != nil {
+		t.Errorf("unexpected probe %+v", probe)
+	}
+
+	if _, err := probeFromLabels(map[string]interface{}{verifyURLLabel: "http://app", verifyBodyLabel: "("}); err == nil {
+		t.Error("expected invalid body regex to fail")
+	}
+}
+
+func Test_probeRun(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 2 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprint(w, `{"status":"UP"}`)
+	}))
+	defer server.Close()
+
+	probe, _ := probeFromLabels(map[string]interface{}{
+		verifyURLLabel:      server.URL,
+		verifyBodyLabel:     `"status":"UP"`,
+		verifyIntervalLabel: "0",
+	})
+	if err := probe.run(); err != nil {
+		t.Fatalf("expected probe to pass after retry: %s", err)
+	}
+
+	probe.Retries = 0
+	probe.Body = regexp.MustCompile("DOWN")
+	if err := probe.run(); err == nil {
+		t.Error("expected body mismatch to fail")
+	}
+}
+
+func Test_upgradeServiceFailingProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+	updater, service := newTestUpdater(testService(map[string]interface{}{
+		verifyURLLabel:      server.URL,
+		verifyRetriesLabel:  "0",
+		verifyIntervalLabel: "0",
+		onFailureLabel:      FailurePolicyRollback,
+	}))
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.upgradeService(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	if len(service.finished) != 0 {
+		t.Errorf("expected the failing probe to block the finish, got %v", service.finished)
+	}
+	if len(service.rolledBack) != 1 {
+		t.Errorf("expected the failure policy to roll back, got %v", service.rolledBack)
+	}
+	if job.Status != JobFailed || job.Services[0].Status != ServiceRolledBack {
+		t.Errorf("unexpected job %+v %+v", job, job.Services[0])
+	}
+}
+
+func Test_handleFailureUpgrading(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{onFailureLabel: FailurePolicyRollback}))
+	service.setState("1s1", "upgrading")
+	if err := updater.handleFailure(service.services[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.rolledBack) != 1 || service.states["1s1"] != "active" {
+		t.Errorf("expected the upgrade to be canceled and rolled back, got %v %s", service.rolledBack, service.states["1s1"])
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/objectpartners/rancher-service-updater/utils"
+)
+
+const (
+	windowLabel = "autoupdate.window"
+	freezesFile = "freezes.json"
+)
+
+var windowCheckInterval = time.Minute
+
+// cronSchedule matches times against a five field cron expression (minute hour day-of-month month day-of-week)
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// Window is a recurring period in which upgrades are allowed. It opens at every time matching
+// the cron expression and stays open for the duration.
+type Window struct {
+	Environment string
+	Spec        string
+	Duration    time.Duration
+	Location    *time.Location
+	schedule    cronSchedule
+}
+
+// Freeze is a period in which no upgrades happen in the matching environments
+type Freeze struct {
+	ID           string    `json:"id"`
+	Environments string    `json:"environments"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Reason       string    `json:"reason,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// FreezeStore keeps the change freezes by id and saves them to freezes.json in the data
+// directory, if one is configured
+type FreezeStore struct {
+	mu      sync.Mutex
+	freezes map[string]*Freeze
+	path    string
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("Invalid step in %s", field)
+			}
+			step = s
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("Invalid value in %s", field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("Invalid value in %s", field)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("Value out of range in %s", field)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("Invalid cron expression %s, expected 5 fields", spec)
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return c, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return c, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return c, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return c, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return c, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDom, c.anyDow = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return c.matchesDay(t)
+}
+
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	// Like cron, a restricted day of month and day of week match if either matches
+	if !c.anyDom && !c.anyDow {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first minute after t matching the schedule, in the location of t, or the zero time
+// if none does within five years. Months, days and hours that do not match are skipped as a whole.
+func (c cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			// Added rather than constructed, so that an hour repeated by a daylight saving change is not skipped
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseWindow parses a window in the form `cron|duration[|time zone]`
+func parseWindow(spec string) (*Window, error) {
+	parts := strings.Split(spec, "|")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("Invalid window %s, expected cron|duration|time zone", spec)
+	}
+	schedule, err := parseCron(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || duration < time.Minute {
+		return nil, fmt.Errorf("Invalid duration %s of window %s", parts[1], spec)
+	}
+	location := time.UTC
+	if len(parts) == 3 && strings.TrimSpace(parts[2]) != "" {
+		if location, err = time.LoadLocation(strings.TrimSpace(parts[2])); err != nil {
+			return nil, fmt.Errorf("Invalid time zone %s of window %s", parts[2], spec)
+		}
+	}
+	return &Window{Spec: spec, Duration: duration, Location: location, schedule: schedule}, nil
+}
+
+// parseWindows parses `;` separated windows in the form `environment pattern|cron|duration[|time zone]`
+func parseWindows(value string) ([]*Window, error) {
+	var windows []*Window
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		// The environment pattern may contain | itself, so the window is split from the right.
+		// A time zone is never a valid duration.
+		parts := strings.Split(spec, "|")
+		n := 2
+		if _, err := time.ParseDuration(strings.TrimSpace(parts[len(parts)-1])); err != nil {
+			n = 3
+		}
+		if len(parts) <= n {
+			return nil, fmt.Errorf("Invalid window %s, expected environment|cron|duration|time zone", spec)
+		}
+		pattern := strings.Join(parts[:len(parts)-n], "|")
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid environment pattern of window %s: %s", spec, err)
+		}
+		window, err := parseWindow(strings.Join(parts[len(parts)-n:], "|"))
+		if err != nil {
+			return nil, err
+		}
+		window.Environment = pattern
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// open reports whether the window is open at the time, that is whether it opened within the duration before
+func (w *Window) open(t time.Time) bool {
+	t = t.In(w.Location).Truncate(time.Minute)
+	opened := w.schedule.next(t.Add(-w.Duration))
+	return !opened.IsZero() && !opened.After(t)
+}
+
+// next returns the first time at or after t the window is open, or the zero time if it never opens
+func (w *Window) next(t time.Time) time.Time {
+	if w.open(t) {
+		return t
+	}
+	return w.schedule.next(t.In(w.Location))
+}
+
+// openFreezes loads the freezes saved in the data directory. Without a data directory the
+// freezes are kept in memory only.
+func openFreezes(dir string) (*FreezeStore, error) {
+	fs := &FreezeStore{freezes: make(map[string]*Freeze)}
+	if dir == "" {
+		return fs, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fs.path = filepath.Join(dir, freezesFile)
+	content, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var freezes []*Freeze
+	if err := json.Unmarshal(content, &freezes); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", fs.path, err)
+	}
+	for _, f := range freezes {
+		fs.freezes[f.ID] = f
+	}
+	return fs, nil
+}
+
+// save writes the freezes to the freezes file, replacing it atomically. It must be called with the lock held.
+func (fs *FreezeStore) save() error {
+	if fs.path == "" {
+		return nil
+	}
+	freezes := make([]*Freeze, 0, len(fs.freezes))
+	for _, f := range fs.freezes {
+		freezes = append(freezes, f)
+	}
+	sort.Slice(freezes, func(i, k int) bool { return freezes[i].ID < freezes[k].ID })
+	content, err := json.MarshalIndent(freezes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fs.path)
+}
+
+// add stores the freeze, dropping the freezes that have ended
+func (fs *FreezeStore) add(f *Freeze) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	now := time.Now()
+	for id, o := range fs.freezes {
+		if !now.Before(o.End) {
+			delete(fs.freezes, id)
+		}
+	}
+	fs.freezes[f.ID] = f
+	return fs.save()
+}
+
+// remove removes the freeze and reports whether it existed
+func (fs *FreezeStore) remove(id string) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.freezes[id]; !ok {
+		return false, nil
+	}
+	delete(fs.freezes, id)
+	return true, fs.save()
+}
+
+// list returns the freezes that have not ended at the time
+func (fs *FreezeStore) list(now time.Time) []*Freeze {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	freezes := make([]*Freeze, 0, len(fs.freezes))
+	for _, f := range fs.freezes {
+		if !now.Before(f.End) {
+			continue
+		}
+		freezes = append(freezes, f)
+	}
+	sort.Slice(freezes, func(i, k int) bool { return freezes[i].Start.Before(freezes[k].Start) })
+	return freezes
+}
+
+// active returns the freeze of the environment in effect at the time
+func (fs *FreezeStore) active(env string, now time.Time) *Freeze {
+	for _, f := range fs.list(now) {
+		if !now.Before(f.Start) && utils.EnvironmentEnabled(env, []string{f.Environments}) {
+			return f
+		}
+	}
+	return nil
+}
+
+// windowFor returns the maintenance window of the candidate, the service label taking precedence
+func (s *ServiceUpdater) windowFor(c Candidate) (*Window, error) {
+	if spec, ok := label(c.Service.LaunchConfig.Labels, windowLabel); ok && spec != "" {
+		window, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s label of service %s: %s", windowLabel, c.Service.Name, err)
+		}
+		return window, nil
+	}
+	for _, window := range s.Config.Windows {
+		if utils.EnvironmentEnabled(c.Environment, []string{window.Environment}) {
+			return window, nil
+		}
+	}
+	return nil, nil
+}
+
+// blocked returns why the candidate cannot be upgraded at the time and when it can be, or an
+// empty reason if it can be upgraded now. Paused candidates can be upgraded once the pause is lifted.
+func (s *ServiceUpdater) blocked(c Candidate, now time.Time) (string, time.Time, error) {
+	if p := s.pauses.active(c.Environment); p != nil {
+		return p.reason(), time.Time{}, nil
+	}
+	window, err := s.windowFor(c)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var reason string
+	at := now
+	for i := 0; i < 10; i++ {
+		if f := s.freezes.active(c.Environment, at); f != nil {
+			if reason == "" {
+				reason = fmt.Sprintf("Change freeze until %s", f.End.Format(time.RFC3339))
+				if f.Reason != "" {
+					reason = fmt.Sprintf("%s: %s", reason, f.Reason)
+				}
+			}
+			at = f.End
+			continue
+		}
+		if window != nil && !window.open(at) {
+			if reason == "" {
+				reason = fmt.Sprintf("Outside maintenance window %s", window.Spec)
+			}
+			if at = window.next(at); at.IsZero() {
+				return reason, at, nil
+			}
+			continue
+		}
+		break
+	}
+	return reason, at, nil
+}
+
+// schedule queues the upgrade of the candidates if any of them cannot be upgraded now, and
+// reports whether it did. The upgrade is run once all of them can be upgraded.
+func (s *ServiceUpdater) schedule(job *Job, command UpdateCommand, candidates []Candidate, targets []*JobService, run func()) bool {
+	if p := s.dropped(candidates); p != nil {
+		reason := fmt.Sprintf("Dropped while paused: %s", p.reason())
+		s.jobLog(job).infof("%s upgrade of %d service(s) in job %s", reason, len(targets), job.ID)
+		job.update(func() {
+			job.Error = reason
+			for _, target := range targets {
+				target.Status = ServiceDropped
+				target.Reason = p.reason()
+			}
+		})
+		return true
+	}
+	var reason string
+	var at time.Time
+	for _, c := range candidates {
+		r, a, err := s.blocked(c, time.Now().UTC())
+		if err != nil {
+			s.jobLog(job).errorf("Unable to schedule upgrade: %s", err)
+			job.update(func() {
+				for _, target := range targets {
+					target.Status = ServiceFailed
+					target.Error = err.Error()
+				}
+			})
+			return true
+		}
+		if r != "" && (reason == "" || (!at.IsZero() && (a.IsZero() || a.After(at)))) {
+			reason, at = r, a
+		}
+	}
+	if reason == "" {
+		return false
+	}
+	item := &queuedUpgrade{job: job, command: command, candidates: candidates, targets: targets, run: run}
+	job.update(func() {
+		item.status = targets[0].Status
+		for _, target := range targets {
+			target.Status = ServiceQueued
+			target.Reason = reason
+			if !at.IsZero() {
+				scheduled := at.UTC()
+				target.Scheduled = &scheduled
+			}
+		}
+	})
+	s.queue.add(item)
+	s.metrics.queueDepth(s.queue.len())
+	s.jobLog(job).infof("Queued upgrade of %d service(s) in job %s: %s", len(targets), job.ID, reason)
+	return true
+}
+
+// restoreQueue starts the jobs that were queued before a restart again, as new jobs. Their
+// services are matched again, so that upgrades that already ran are not repeated, and upgrades
+// that need an approval wait for it again.
+func (s *ServiceUpdater) restoreQueue() {
+	for _, queued := range s.queue.takeRestored() {
+		command := queued.Command
+		job := s.jobStore.create(command.Image)
+		job.update(func() {
+			job.Environments = command.Environments
+			job.Trigger = queued.Trigger
+			job.Caller = queued.Caller
+			if len(command.Images) > 0 {
+				job.Release = command.Release
+				job.Images = command.Images
+			}
+		})
+		s.jobLog(job).infof("Restoring job %s queued before the restart", queued.JobID)
+		s.auditJob(job)
+		go func(id string) {
+			s.runJob(job, command)
+			s.queue.forget(id)
+		}(queued.JobID)
+	}
+}
+
+// runQueue starts queued upgrades once their windows open
+func (s *ServiceUpdater) runQueue() {
+	for range time.Tick(windowCheckInterval) {
+		s.drainQueue(time.Now().UTC())
+	}
+}
+
+func (s *ServiceUpdater) drainQueue(now time.Time) {
+	ready := s.queue.ready(func(item *queuedUpgrade) bool {
+		for _, c := range item.candidates {
+			if reason, _, err := s.blocked(c, now); reason != "" || err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	started := time.Now().UTC()
+	for _, item := range ready {
+		item.job.update(func() {
+			item.job.Status = JobRunning
+			for _, target := range item.targets {
+				target.Status = item.status
+				target.Reason = ""
+				target.Scheduled = nil
+				target.Started = &started
+			}
+		})
+		go func(item *queuedUpgrade) {
+			item.run()
+			remaining := s.queue.done(item)
+			s.metrics.queueDepth(s.queue.len())
+			if remaining == 0 {
+				item.job.finish()
+				s.complete(item.job, item.command)
+			}
+			// Start the upgrades that waited for this one
+			s.drainQueue(time.Now().UTC())
+		}(item)
+	}
+}
+
+func (s *ServiceUpdater) freezesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/freezes"), "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		sendJSON(w, s.freezes.list(time.Now()), 200)
+	case id == "" && r.Method == "POST":
+		var f Freeze
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			utils.SendError(w, err.Error(), 400)
+			return
+		}
+		if f.Environments == "" {
+			f.Environments = ".*"
+		}
+		if _, err := regexp.Compile(f.Environments); err != nil {
+			utils.SendError(w, fmt.Sprintf("Invalid environments pattern: %s", err), 400)
+			return
+		}
+		f.ID, f.Created = newID(), time.Now().UTC()
+		if f.Start.IsZero() {
+			f.Start = f.Created
+		}
+		if !f.End.After(f.Start) {
+			utils.SendError(w, "end must be after start", 400)
+			return
+		}
+		if err := s.freezes.add(&f); err != nil {
+			utils.SendError(w, err.Error(), 500)
+			return
+		}
+		s.audit.add(AuditFreeze, caller(r), map[string]interface{}{
+			"action": "added", "id": f.ID, "environments": f.Environments, "start": f.Start, "end": f.End, "reason": f.Reason,
+		})
+		s.log.infof("Freezing %s until %s", f.Environments, f.End.Format(time.RFC3339))
+		sendJSON(w, f, 201)
+	case id != "" && r.Method == "DELETE":
+		removed, err := s.freezes.remove(id)
+		if err != nil {
+			utils.SendError(w, err.Error(), 500)
+			return
+		}
+		if !removed {
+			utils.SendError(w, "Freeze not found", 404)
+			return
+		}
+		s.audit.add(AuditFreeze, caller(r), map[string]interface{}{"action": "removed", "id": id})
+		w.WriteHeader(204)
+	default:
+		utils.SendError(w, "Method not allowed", 405)
+	}
+}
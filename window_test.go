@@ -0,0 +1,245 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func Test_parseCron(t *testing.T) {
+	c, err := parseCron("*/15 9-17 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2017, 1, 23, 9, 30, 0, 0, time.UTC)
+	if !c.matches(monday) {
+		t.Errorf("expected %s to match", monday)
+	}
+	for _, tm := range []time.Time{monday.Add(time.Minute), monday.Add(9 * time.Hour), monday.AddDate(0, 0, 5)} {
+		if c.matches(tm) {
+			t.Errorf("expected %s not to match", tm)
+		}
+	}
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * * * mon", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("expected %s to fail", spec)
+		}
+	}
+}
+
+func Test_windowOpen(t *testing.T) {
+	w, err := parseWindow("0 22 * * *|2h|Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	berlin := w.Location
+	if !w.open(time.Date(2017, 1, 25, 23, 59, 0, 0, berlin)) || !w.open(time.Date(2017, 1, 25, 21, 30, 0, 0, time.UTC)) {
+		t.Error("expected window to be open")
+	}
+	closed := time.Date(2017, 1, 26, 12, 0, 0, 0, berlin)
+	if w.open(closed) {
+		t.Error("expected window to be closed")
+	}
+	if next := w.next(closed); !next.Equal(time.Date(2017, 1, 26, 22, 0, 0, 0, berlin)) {
+		t.Errorf("unexpected next opening %s", next)
+	}
+	leap, _ := parseWindow("0 0 29 2 *|1h")
+	if next := leap.next(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)); !next.Equal(time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next opening of leap day window %s", next)
+	}
+	if _, err := parseWindow("0 22 * * *|2h|Mars/Olympus"); err == nil {
+		t.Error("expected unknown time zone to fail")
+	}
+
+	windows, err := parseWindows("production|0 9 * * 1-4|7h|America/Chicago; qa|0 * * * *|30m")
+	if err != nil || len(windows) != 2 || windows[0].Environment != "production" || windows[1].Location != time.UTC {
+		t.Errorf("unexpected windows %+v %v", windows, err)
+	}
+	windows, err = parseWindows("production|staging|0 9 * * 1-4|7h|America/Chicago; qa|dev|0 * * * *|30m")
+	if err != nil || len(windows) != 2 || windows[0].Environment != "production|staging" || windows[1].Environment != "qa|dev" || windows[1].Duration != 30*time.Minute {
+		t.Errorf("expected environment patterns with alternatives, got %+v %v", windows, err)
+	}
+	if _, err := parseWindows("0 9 * * 1-4|7h|America/Chicago"); err == nil {
+		t.Error("expected window without environment pattern to fail")
+	}
+}
+
+func Test_queuedUpgrade(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	now := time.Now().UTC()
+	updater.freezes.add(&Freeze{ID: "f1", Environments: "dev", Start: now.Add(-time.Minute), End: now.Add(time.Hour), Reason: "release party"})
+	job := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+
+	target := job.Services[0]
+	if job.Status != JobQueued || target.Status != ServiceQueued || target.Scheduled == nil || len(service.upgrades) != 0 {
+		t.Fatalf("expected frozen upgrade to be queued, got %+v %+v", job, target)
+	}
+
+	updater.drainQueue(time.Now().UTC())
+	if job.Status != JobQueued {
+		t.Fatalf("expected upgrade to stay queued during the freeze, got %s", job.Status)
+	}
+
+	updater.freezes.remove("f1")
+	updater.drainQueue(time.Now().UTC())
+	waitForJob(t, job)
+	if job.Status != JobSucceeded || target.Status != ServiceSucceeded || target.Reason != "" {
+		t.Fatalf("expected queued upgrade to run, got %+v", target)
+	}
+}
+
+func Test_blockedWindowLabel(t *testing.T) {
+	updater, _ := newTestUpdater()
+	c := Candidate{Service: testService(map[string]interface{}{windowLabel: "0 2 * * *|1h"}), Environment: "dev"}
+	reason, at, err := updater.blocked(c, time.Date(2017, 1, 25, 12, 0, 0, 0, time.UTC))
+	if err != nil || reason == "" || !at.Equal(time.Date(2017, 1, 26, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected upgrade to wait for the window, got %q %s %v", reason, at, err)
+	}
+	c.Service.LaunchConfig.Labels[windowLabel] = "sometimes"
+	if _, _, err := updater.blocked(c, time.Now()); err == nil {
+		t.Error("expected invalid label to fail")
+	}
+}
+
+func Test_freezesPersisted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "freezes")
+	defer os.RemoveAll(dir)
+	freezes, err := openFreezes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	freezes.add(&Freeze{ID: "f1", Environments: "production", Start: now.Add(-time.Minute), End: now.Add(time.Hour)})
+	freezes.add(&Freeze{ID: "f2", Environments: "qa", Start: now.Add(-time.Minute), End: now.Add(time.Hour)})
+
+	reopened, err := openFreezes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.active("production", now) == nil || len(reopened.list(now)) != 2 {
+		t.Fatalf("expected the freezes to survive a restart, got %+v", reopened.list(now))
+	}
+	if removed, err := reopened.remove("f1"); !removed || err != nil {
+		t.Fatalf("expected the freeze to be removed, got %v %v", removed, err)
+	}
+	if removed, _ := reopened.remove("f1"); removed {
+		t.Error("expected a missing freeze not to be removed")
+	}
+	if reopened, _ := openFreezes(dir); reopened.active("production", now) != nil || reopened.active("qa", now) == nil {
+		t.Errorf("expected the removal to be saved, got %+v", reopened.list(now))
+	}
+
+	ioutil.WriteFile(reopened.path, []byte("{"), 0600)
+	if _, err := openFreezes(dir); err == nil {
+		t.Error("expected an invalid freezes file to fail")
+	}
+}
+
+func Test_queuePersisted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	var err error
+	if updater.queue, err = openQueue(dir); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	updater.freezes.add(&Freeze{ID: "f1", Environments: "dev", Start: now.Add(-time.Minute), End: now.Add(time.Hour)})
+	job := updater.jobStore.create("myorg/api:2.0")
+	job.Caller = "ci"
+	updater.runJob(job, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	if job.Status != JobQueued {
+		t.Fatalf("expected the upgrade to be queued, got %s", job.Status)
+	}
+
+	restarted, _ := newTestUpdater()
+	restarted.service = service
+	restarted.freezes = updater.freezes
+	if restarted.queue, err = openQueue(dir); err != nil {
+		t.Fatal(err)
+	}
+	if queued := restarted.queue.takeRestored(); len(queued) != 1 || queued[0].JobID != job.ID || queued[0].Caller != "ci" {
+		t.Fatalf("expected the queued job to be loaded, got %+v", queued)
+	}
+	if restarted.audit, err = openAuditLog(filepath.Join(dir, auditFile)); err != nil {
+		t.Fatal(err)
+	}
+	restarted.restoreQueue()
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, auditFile)); !strings.Contains(string(content), `"event":"`+AuditTrigger+`"`) || !strings.Contains(string(content), `"actor":"ci"`) {
+		t.Errorf("expected the restored trigger to be audited, got %s", content)
+	}
+	for i := 0; i < 100 && (restarted.queue.len() == 0 || len(restarted.queue.takeRestored()) != 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	jobs := restarted.jobStore.list()
+	if len(jobs) != 1 || jobs[0].Status != JobQueued || jobs[0].Caller != "ci" {
+		t.Fatalf("expected the job to be queued again, got %+v", jobs)
+	}
+	if reopened, _ := openQueue(dir); len(reopened.restored) != 1 || reopened.restored[0].JobID != jobs[0].ID {
+		t.Errorf("expected the new job to be saved instead of the old one, got %+v", reopened.restored)
+	}
+
+	restarted.freezes.remove("f1")
+	restarted.drainQueue(time.Now().UTC())
+	waitForJob(t, jobs[0])
+	if jobs[0].Status != JobSucceeded || len(service.upgrades) != 1 {
+		t.Fatalf("expected the restored job to run once, got %s with %d upgrades", jobs[0].Status, len(service.upgrades))
+	}
+	for i := 0; i < 100 && restarted.queue.len() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reopened, _ := openQueue(dir); len(reopened.restored) != 0 {
+		t.Errorf("expected the queue file to be emptied, got %+v", reopened.restored)
+	}
+}
+
+func Test_queuedUpgradeRechecked(t *testing.T) {
+	updater, service := newTestUpdater(testService(map[string]interface{}{}))
+	now := time.Now().UTC()
+	updater.freezes.add(&Freeze{ID: "f1", Environments: "dev", Start: now.Add(-time.Minute), End: now.Add(time.Hour)})
+	older := updater.jobStore.create("myorg/api:2.0")
+	updater.runJob(older, UpdateCommand{Image: "myorg/api:2.0", Confirm: true, Timeout: 1})
+	newer := updater.jobStore.create("myorg/api:3.0")
+	updater.runJob(newer, UpdateCommand{Image: "myorg/api:3.0", Confirm: true, Timeout: 1})
+	if updater.queue.len() != 2 {
+		t.Fatalf("expected both upgrades to be queued, got %d", updater.queue.len())
+	}
+	updater.freezes.remove("f1")
+	if ready := updater.queue.ready(func(*queuedUpgrade) bool { return true }); len(ready) != 1 || ready[0].job != older {
+		t.Fatalf("expected only the first upgrade of the service to be ready, got %d", len(ready))
+	}
+	updater.queue.items[0].running = false
+
+	// The service was upgraded to 3.0 and reconfigured in Rancher while the upgrades waited
+	service.mu.Lock()
+	service.services[0].LaunchConfig = &client.LaunchConfig{
+		ImageUuid: "docker:myorg/api:2.5",
+		Labels:    map[string]interface{}{"autoupdate.enable": "true", "tier": "web"},
+	}
+	service.mu.Unlock()
+	updater.drainQueue(time.Now().UTC())
+	for i := 0; i < 100 && updater.queue.len() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForJob(t, older)
+	waitForJob(t, newer)
+
+	if older.Status != JobSucceeded || older.Services[0].Status != ServiceSkipped || older.Services[0].Reason == "" {
+		t.Errorf("expected the outdated upgrade to be skipped, got %s %+v", older.Status, older.Services[0])
+	}
+	if newer.Status != JobSucceeded || newer.Services[0].Status != ServiceSucceeded {
+		t.Errorf("expected the newer upgrade to run, got %s %+v", newer.Status, newer.Services[0])
+	}
+	if len(service.upgrades) != 1 {
+		t.Fatalf("expected one upgrade, got %d", len(service.upgrades))
+	}
+	if launchConfig := service.upgrades[0].InServiceStrategy.LaunchConfig; launchConfig.ImageUuid != "docker:myorg/api:3.0" || launchConfig.Labels["tier"] != "web" {
+		t.Errorf("expected the upgrade to start from the current launch config, got %+v", launchConfig)
+	}
+}